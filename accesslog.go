@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// logKeyEnv holds the key for hashing inputs in access logs. Without it the
+// input is left out entirely; with it the log carries an HMAC that lets
+// operators correlate requests for one input without being able to read it.
+const logKeyEnv = "AVATAR_LOG_KEY"
+
+func parseLogLevel(raw string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(raw))
+	return level, err
+}
+
+// openLogOutput resolves the -log-output flag: stderr, stdout or a file that
+// is appended to.
+func openLogOutput(name string) (io.Writer, error) {
+	switch strings.ToLower(name) {
+	case "", "stderr":
+		return os.Stderr, nil
+	case "stdout":
+		return os.Stdout, nil
+	}
+	return os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+}
+
+// setupLogging installs a JSON slog handler as the default logger, which
+// also carries anything written through the log package.
+func setupLogging() error {
+	out, err := openLogOutput(cfg.logOutput)
+	if err != nil {
+		return fmt.Errorf("open log output: %w", err)
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{Level: cfg.logLevel})))
+	return nil
+}
+
+// redactInput returns the attribute that stands in for a raw input.
+func redactInput(input string) slog.Attr {
+	if len(cfg.logKey) == 0 {
+		return slog.String("input", "[redacted]")
+	}
+	mac := hmac.New(sha256.New, cfg.logKey)
+	mac.Write([]byte(input))
+	return slog.String("input_hmac", hex.EncodeToString(mac.Sum(nil)[:12]))
+}
+
+// logAccess writes one access log line. Only the route pattern is logged,
+// never the URL, because both the path and the query can carry the input.
+func logAccess(r *http.Request, route string, status int, bytes int, info *requestInfo, latency time.Duration) {
+	level := slog.LevelInfo
+	if status >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	attrs := []slog.Attr{
+		slog.String("method", r.Method),
+		slog.String("route", route),
+		slog.Int("status", status),
+		slog.Int("bytes", bytes),
+		slog.Float64("latency_ms", float64(latency.Microseconds())/1000),
+	}
+	if info.size != "" {
+		attrs = append(attrs, slog.String("size", info.size))
+	}
+	if info.format != "" {
+		attrs = append(attrs, slog.String("format", info.format))
+	}
+	if info.hash != "" {
+		attrs = append(attrs, slog.String("hash_prefix", info.hash[:12]))
+	}
+	if info.input != "" {
+		attrs = append(attrs, redactInput(info.input))
+	}
+	slog.LogAttrs(r.Context(), level, "access", attrs...)
+}
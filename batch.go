@@ -0,0 +1,215 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+)
+
+const maxBatchBodyBytes = 1 << 20
+
+type batchItem struct {
+	Input     string  `json:"input"`
+	Size      int     `json:"size,omitempty"`
+	Timestamp *int64  `json:"timestamp,omitempty"`
+	Format    string  `json:"format,omitempty"`
+	Rotation  string  `json:"rotation,omitempty"`
+	TZ        string  `json:"tz,omitempty"`
+	Version   int     `json:"v,omitempty"`
+	AA        string  `json:"aa,omitempty"`
+	BG        string  `json:"bg,omitempty"`
+	Shape     string  `json:"shape,omitempty"`
+	DPR       float64 `json:"dpr,omitempty"`
+	Expires   *int64  `json:"expires,omitempty"`
+	Sig       string  `json:"sig,omitempty"`
+}
+
+func (b batchItem) params() avatarParams {
+	p := avatarParams{input: b.Input, format: b.Format, rotation: b.Rotation, tz: b.TZ, aa: b.AA, bg: b.BG, shape: b.Shape, sig: b.Sig}
+	if b.Size != 0 {
+		p.size = strconv.Itoa(b.Size)
+	}
+	if b.Timestamp != nil {
+		p.timestamp = strconv.FormatInt(*b.Timestamp, 10)
+	}
+	if b.Version != 0 {
+		p.version = strconv.Itoa(b.Version)
+	}
+	if b.DPR != 0 {
+		p.dpr = formatDPR(b.DPR)
+	}
+	if b.Expires != nil {
+		p.expires = strconv.FormatInt(*b.Expires, 10)
+	}
+	return p
+}
+
+type batchResult struct {
+	Input   string `json:"input"`
+	Size    int    `json:"size"`
+	Format  string `json:"format"`
+	Hash    string `json:"hash"`
+	TimeKey string `json:"timeKey"`
+	DataURI string `json:"dataUri,omitempty"`
+	File    string `json:"file,omitempty"`
+
+	body []byte
+}
+
+// batchHandler renders a JSON array of avatar requests in one round-trip.
+// The response is a JSON document of data URIs, or a ZIP archive with a
+// manifest when the client asks for application/zip.
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	asZip, err := batchWantsZip(r)
+	if err != nil {
+		http.Error(w, err.Error(), requestStatus(err))
+		return
+	}
+	if asZip {
+		labelRequest(r, 0, "zip")
+	} else {
+		labelRequest(r, 0, "json")
+	}
+
+	var items []batchItem
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBodyBytes)).Decode(&items); err != nil {
+		http.Error(w, "invalid JSON body: expected an array of avatar requests", http.StatusBadRequest)
+		return
+	}
+	if len(items) == 0 {
+		http.Error(w, "empty batch", http.StatusBadRequest)
+		return
+	}
+	if len(items) > cfg.batchLimit {
+		http.Error(w, fmt.Sprintf("batch has %d items, the limit is %d", len(items), cfg.batchLimit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !chargeItems(w, r, len(items)) {
+		return
+	}
+
+	reqs := make([]avatarRequest, len(items))
+	for i, item := range items {
+		req, err := parseAvatarRequest(item.params())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("item %d: %v", i, err), requestStatus(err))
+			return
+		}
+		reqs[i] = req
+	}
+
+	results, err := renderBatch(reqs)
+	if err != nil {
+		http.Error(w, "failed to encode image", http.StatusInternalServerError)
+		return
+	}
+
+	if asZip {
+		archive, err := zipBatch(results)
+		if err != nil {
+			http.Error(w, "failed to build archive", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="avatars.zip"`)
+		w.Write(archive)
+		return
+	}
+	for i := range results {
+		results[i].DataURI = "data:" + formatMediaTypes[avatarFormat(results[i].Format)] + ";base64," + base64.StdEncoding.EncodeToString(results[i].body)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Avatars []batchResult `json:"avatars"`
+	}{results})
+}
+
+func batchWantsZip(r *http.Request) (bool, error) {
+	switch output := r.URL.Query().Get("output"); output {
+	case "zip":
+		return true, nil
+	case "json":
+		return false, nil
+	case "":
+		output, ok := negotiate(parseAccept(r.Header.Get("Accept")), []string{"application/json", "application/zip"}, func(t string) string {
+			return t
+		})
+		if !ok {
+			return false, fmt.Errorf("%w: this endpoint serves application/json and application/zip", errNotAcceptable)
+		}
+		return output == "application/zip", nil
+	default:
+		return false, fmt.Errorf("unsupported output %q", output)
+	}
+}
+
+// renderBatch renders reqs on a pool of GOMAXPROCS workers, keeping results
+// in request order.
+func renderBatch(reqs []avatarRequest) ([]batchResult, error) {
+	results := make([]batchResult, len(reqs))
+	errs := make([]error, len(reqs))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for n := min(runtime.GOMAXPROCS(0), len(reqs)); n > 0; n-- {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				req := reqs[i]
+				hash := req.hash()
+				var body bytes.Buffer
+				errs[i] = encodeAvatar(&body, hash, req)
+				results[i] = batchResult{
+					Input:   req.input,
+					Size:    req.size,
+					Format:  string(req.format),
+					Hash:    hex.EncodeToString(hash),
+					TimeKey: req.window.key,
+					body:    body.Bytes(),
+				}
+			}
+		}()
+	}
+	for i := range reqs {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results, errors.Join(errs...)
+}
+
+func zipBatch(results []batchResult) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for i := range results {
+		results[i].File = fmt.Sprintf("%03d-%s.%s", i, results[i].Hash[:12], results[i].Format)
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: results[i].File, Method: zip.Store})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write(results[i].body); err != nil {
+			return nil, err
+		}
+	}
+	manifest, err := zw.Create("manifest.json")
+	if err != nil {
+		return nil, err
+	}
+	if err := json.NewEncoder(manifest).Encode(struct {
+		Avatars []batchResult `json:"avatars"`
+	}{results}); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// batchBody lists enough items to keep every worker busy, with sizes and
+// formats that take very different times to render.
+func batchBody() (string, []string) {
+	var items, urls []string
+	for i, input := range []string{"alice", "bob", "carol", "dave", "erin", "frank", "grace", "heidi", "ivan", "judy", "mallory", "niaj"} {
+		size, format := "256", "png"
+		if i%3 == 1 {
+			size = "16"
+		}
+		if i%4 == 2 {
+			format = "svg"
+		}
+		items = append(items, `{"input":"`+input+`","size":`+size+`,"format":"`+format+`","timestamp":1700000000}`)
+		urls = append(urls, "/avatar?input="+input+"&size="+size+"&format="+format+"&timestamp=1700000000")
+	}
+	return "[" + strings.Join(items, ",") + "]", urls
+}
+
+func postBatch(t *testing.T, query string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	batchHandler(rec, httptest.NewRequest(http.MethodPost, "/avatars"+query, strings.NewReader(body)))
+	return rec
+}
+
+// single renders what GET /avatar returns for url.
+func single(t *testing.T, url string) []byte {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	avatarHandler(rec, httptest.NewRequest(http.MethodGet, url, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%s: status %d", url, rec.Code)
+	}
+	return rec.Body.Bytes()
+}
+
+func TestBatchKeepsRequestOrder(t *testing.T) {
+	body, urls := batchBody()
+	rec := postBatch(t, "", body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var resp struct {
+		Avatars []batchResult `json:"avatars"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Avatars) != len(urls) {
+		t.Fatalf("%d avatars for %d items", len(resp.Avatars), len(urls))
+	}
+	for i, a := range resp.Avatars {
+		_, data, _ := strings.Cut(a.DataURI, ";base64,")
+		got, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			t.Fatalf("item %d: %v", i, err)
+		}
+		if !bytes.Equal(got, single(t, urls[i])) {
+			t.Errorf("item %d (%s) is not what %s renders", i, a.Input, urls[i])
+		}
+	}
+}
+
+// TestBatchLargerThanRateBurst posts more items than the rate burst with the
+// default configuration, which does not rate limit, so the batch limit alone
+// applies.
+func TestBatchLargerThanRateBurst(t *testing.T) {
+	items := cfg.rateBurst + 1
+	body := "[" + strings.TrimSuffix(strings.Repeat(`{"input":"alice","size":16},`, items), ",") + "]"
+	r := httptest.NewRequest(http.MethodPost, "/avatars", strings.NewReader(body))
+	r.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	newMux().ServeHTTP(rec, r)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("batch of %d: status %d: %s", items, rec.Code, rec.Body)
+	}
+	var resp struct {
+		Avatars []batchResult `json:"avatars"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Avatars) != items {
+		t.Errorf("%d avatars for %d items", len(resp.Avatars), items)
+	}
+}
+
+func TestBatchZipKeepsRequestOrder(t *testing.T) {
+	body, urls := batchBody()
+	rec := postBatch(t, "?output=zip", body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != len(urls)+1 || zr.File[len(urls)].Name != "manifest.json" {
+		t.Fatalf("archive has %d files, want %d avatars and a manifest", len(zr.File), len(urls))
+	}
+	for i, url := range urls {
+		f, err := zr.File[i].Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(f)
+		f.Close()
+		if !bytes.Equal(got, single(t, url)) {
+			t.Errorf("file %d (%s) is not what %s renders", i, zr.File[i].Name, url)
+		}
+	}
+}
+
+func TestBatchRejectsBadItems(t *testing.T) {
+	for _, tc := range []struct {
+		body string
+		want int
+		msg  string
+	}{
+		{`[{"input":"a"},{"input":""}]`, http.StatusBadRequest, "item 1: missing input"},
+		{`[{"input":"a"},{"input":"b","format":"gif"}]`, http.StatusBadRequest, "item 1: unsupported format"},
+		{`[]`, http.StatusBadRequest, "empty batch"},
+		{`{"input":"a"}`, http.StatusBadRequest, "invalid JSON body"},
+	} {
+		rec := postBatch(t, "", tc.body)
+		if rec.Code != tc.want || !strings.HasPrefix(rec.Body.String(), tc.msg) {
+			t.Errorf("%s: status %d %q, want %d %q", tc.body, rec.Code, rec.Body, tc.want, tc.msg)
+		}
+	}
+}
+
+func TestBatchWantsZip(t *testing.T) {
+	for _, tc := range []struct {
+		query  string
+		accept string
+		want   bool
+		err    bool
+	}{
+		{"", "", false, false},
+		{"", "application/zip", true, false},
+		{"", "application/json;q=0.5, application/zip", true, false},
+		{"", "*/*", false, false},
+		{"", "image/png", false, true},
+		{"?output=zip", "application/json", true, false},
+		{"?output=json", "", false, false},
+		{"?output=tar", "", false, true},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/avatars"+tc.query, nil)
+		r.Header.Set("Accept", tc.accept)
+		got, err := batchWantsZip(r)
+		if got != tc.want || (err != nil) != tc.err {
+			t.Errorf("%s with Accept %q: %v, %v", tc.query, tc.accept, got, err)
+		}
+	}
+}
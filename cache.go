@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pinnedMaxAge is used for requests with an explicit timestamp: their time
+// key can never roll over, so the response is effectively immutable.
+const pinnedMaxAge = 365 * 24 * time.Hour
+
+func avatarETag(hash []byte, size int, format avatarFormat, opts renderOptions) string {
+	h := sha256.New()
+	h.Write(hash)
+	h.Write([]byte("|" + strconv.Itoa(size) + "|" + string(format) + "|v" + strconv.Itoa(opts.version)))
+	if key := opts.key(); key != "" {
+		h.Write([]byte("|" + key))
+	}
+	if signature := cfg.layers.signature(); signature != "" {
+		h.Write([]byte("|" + signature))
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// setCacheHeaders lets caches keep the avatar exactly until its time window
+// ends, which is the moment the rendered image changes.
+func setCacheHeaders(header http.Header, etag string, window timeWindow, now time.Time) {
+	header.Set("ETag", etag)
+	header.Set("Last-Modified", window.start.UTC().Format(http.TimeFormat))
+	if window.pinned {
+		header.Set("Cache-Control", "public, max-age="+strconv.Itoa(int(pinnedMaxAge.Seconds()))+", immutable")
+		header.Set("Expires", now.Add(pinnedMaxAge).UTC().Format(http.TimeFormat))
+		return
+	}
+	maxAge := int(window.end.Sub(now).Seconds())
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	header.Set("Cache-Control", "public, max-age="+strconv.Itoa(maxAge))
+	header.Set("Expires", window.end.UTC().Format(http.TimeFormat))
+}
+
+// notModified evaluates If-None-Match, falling back to If-Modified-Since only
+// when no entity tag was sent, as RFC 9110 requires. The outcome is counted
+// as a cache hit or miss.
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	hit := conditionalMatch(r, etag, lastModified)
+	if hit {
+		cacheRequests.inc("hit")
+	} else {
+		cacheRequests.inc("miss")
+	}
+	return hit
+}
+
+func conditionalMatch(r *http.Request, etag string, lastModified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagMatches(inm, etag)
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		since, err := http.ParseTime(ims)
+		return err == nil && !lastModified.Truncate(time.Second).After(since)
+	}
+	return false
+}
+
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSetCacheHeaders(t *testing.T) {
+	now := time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC)
+	start := time.Date(2023, 11, 14, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name    string
+		window  timeWindow
+		control string
+		expires string
+	}{
+		{"until the window ends", timeWindow{start: start, end: start.AddDate(0, 0, 1)}, "public, max-age=6400", "Wed, 15 Nov 2023 00:00:00 GMT"},
+		{"window already over", timeWindow{start: start, end: now.Add(-time.Minute)}, "public, max-age=0", "Tue, 14 Nov 2023 22:12:20 GMT"},
+		{"pinned", timeWindow{start: start, end: start.AddDate(0, 0, 1), pinned: true}, "public, max-age=31536000, immutable", "Wed, 13 Nov 2024 22:13:20 GMT"},
+	} {
+		header := http.Header{}
+		setCacheHeaders(header, `"abc"`, tc.window, now)
+		if got := header.Get("Cache-Control"); got != tc.control {
+			t.Errorf("%s: Cache-Control %q, want %q", tc.name, got, tc.control)
+		}
+		if got := header.Get("Expires"); got != tc.expires {
+			t.Errorf("%s: Expires %q, want %q", tc.name, got, tc.expires)
+		}
+		if got := header.Get("Last-Modified"); got != "Tue, 14 Nov 2023 00:00:00 GMT" {
+			t.Errorf("%s: Last-Modified %q", tc.name, got)
+		}
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	const url = "/avatar?input=alice&timestamp=1700000000"
+	rec := httptest.NewRecorder()
+	avatarHandler(rec, httptest.NewRequest(http.MethodGet, url, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+	etag, lastModified := rec.Header().Get("ETag"), rec.Header().Get("Last-Modified")
+	if etag == "" || lastModified == "" {
+		t.Fatalf("ETag %q, Last-Modified %q", etag, lastModified)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		header map[string]string
+		want   int
+	}{
+		{"matching etag", map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{"weak etag in a list", map[string]string{"If-None-Match": `"other", W/` + etag}, http.StatusNotModified},
+		{"any etag", map[string]string{"If-None-Match": "*"}, http.StatusNotModified},
+		{"other etag", map[string]string{"If-None-Match": `"other"`}, http.StatusOK},
+		{"not modified since", map[string]string{"If-Modified-Since": lastModified}, http.StatusNotModified},
+		{"modified since", map[string]string{"If-Modified-Since": "Sat, 01 Jan 2000 00:00:00 GMT"}, http.StatusOK},
+		{"etag wins over date", map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": lastModified}, http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		for k, v := range tc.header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		avatarHandler(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.name, rec.Code, tc.want)
+		}
+		if rec.Code == http.StatusNotModified && rec.Body.Len() != 0 {
+			t.Errorf("%s: 304 with a %d byte body", tc.name, rec.Body.Len())
+		}
+	}
+}
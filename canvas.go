@@ -0,0 +1,772 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"slices"
+	"strings"
+)
+
+// vec is a point in canvas space. Integer coordinates are pixel centres, so
+// pixel (x, y) covers the square from (x-0.5, y-0.5) to (x+0.5, y+0.5).
+type vec struct {
+	X, Y float64
+}
+
+func pt(x, y int) vec {
+	return vec{X: float64(x), Y: float64(y)}
+}
+
+// canvas is the drawing surface shared by the raster and vector encoders.
+// Every draw* function goes through it, so a PNG and an SVG built from the
+// same hash receive exactly the same shapes in the same order.
+type canvas interface {
+	Size() int
+	FillRect(x0, y0, x1, y1 float64, fill color.RGBA)
+	FillCircle(center vec, radius float64, fill color.RGBA)
+	FillEllipse(center vec, rx, ry float64, fill color.RGBA)
+	FillPolygon(points []vec, fill color.RGBA)
+	StrokePolyline(points []vec, width float64, stroke color.RGBA)
+	FillVerticalGradient(x0, y0, x1, y1 float64, top, bottom color.RGBA)
+	PushClipRect(x0, y0, x1, y1 float64)
+	// PushMask clips the following shapes to the named mask, or to
+	// everything outside it when invert is set. A mask that was never
+	// recorded is empty.
+	PushMask(name string, invert bool)
+	PopClip()
+	// BeginMask records the area covered by the following shapes, as they
+	// are drawn, into the named mask until EndMask.
+	BeginMask(name string)
+	EndMask()
+	Vignette(center vec, radius float64)
+	Noise(rng randStream, intensity int)
+	// SetBlendMode selects how the following shapes combine with what is
+	// already drawn.
+	SetBlendMode(mode blendMode)
+	// Crop cuts the finished image to shape with an anti-aliased edge.
+	Crop(shape cropShape)
+}
+
+// blendMode is a W3C compositing blend mode. Every mode is applied with
+// source-over alpha compositing, treating fill colours as straight alpha,
+// except blendReplace.
+type blendMode string
+
+const (
+	blendNormal   blendMode = "normal"
+	blendMultiply blendMode = "multiply"
+	blendScreen   blendMode = "screen"
+	blendOverlay  blendMode = "overlay"
+	// blendReplace overwrites crisp pixels with the fill colour, alpha
+	// included, as the service drew before it composited. Versions that
+	// predate compositing draw with it; anti-aliased edges need
+	// compositing, so elsewhere it draws as normal.
+	blendReplace blendMode = "replace"
+)
+
+func parseBlendMode(raw string) (blendMode, error) {
+	switch mode := blendMode(strings.ToLower(raw)); mode {
+	case blendNormal, blendMultiply, blendScreen, blendOverlay:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown blend mode %q", raw)
+}
+
+// blendChannel mixes a backdrop and source channel, both straight and in
+// [0, 1], as the blend mode defines.
+func blendChannel(mode blendMode, backdrop, source float64) float64 {
+	switch mode {
+	case blendMultiply:
+		return backdrop * source
+	case blendScreen:
+		return backdrop + source - backdrop*source
+	case blendOverlay:
+		if backdrop <= 0.5 {
+			return 2 * backdrop * source
+		}
+		return blendChannel(blendScreen, 2*backdrop-1, source)
+	}
+	return source
+}
+
+type rasterCanvas struct {
+	img   *image.RGBA
+	clips []rasterClip
+	mode  blendMode
+	// masks holds recorded masks as one coverage byte per pixel, and
+	// recording is the mask being recorded, if any.
+	masks         map[string][]uint8
+	recording     []uint8
+	recordingName string
+	// samples is the supersampling factor per axis. With one sample a pixel
+	// is either covered at its centre or not; with more, shape edges are
+	// drawn with partial coverage using the same geometry as the SVG output.
+	samples int
+	// reference tests every pixel centre against each shape instead of
+	// filling spans, as the original rasteriser did. Tests set it to check
+	// the span path against it.
+	reference bool
+}
+
+func newRasterCanvas(img *image.RGBA) *rasterCanvas {
+	return &rasterCanvas{img: img, clips: []rasterClip{{rect: img.Bounds()}}, mode: blendNormal, samples: 1}
+}
+
+// rasterClip limits drawing to rect and, when mask is set, scales each
+// pixel's coverage by the mask.
+type rasterClip struct {
+	rect image.Rectangle
+	mask []uint8
+}
+
+// newSmoothRasterCanvas returns a canvas that anti-aliases with samples by
+// samples supersampling.
+func newSmoothRasterCanvas(img *image.RGBA, samples int) *rasterCanvas {
+	r := newRasterCanvas(img)
+	r.samples = max(1, samples)
+	return r
+}
+
+func (r *rasterCanvas) smooth() bool {
+	return r.samples > 1
+}
+
+// spans reports whether shapes are filled a row span at a time. Only crisp
+// edges have spans; supersampled edges need per-pixel coverage.
+func (r *rasterCanvas) spans() bool {
+	return !r.reference && !r.smooth()
+}
+
+func (r *rasterCanvas) SetBlendMode(mode blendMode) {
+	r.mode = mode
+}
+
+// overwrites reports whether fills replace pixels instead of compositing.
+// Pixels drawn this way hold straight rather than premultiplied colour.
+func (r *rasterCanvas) overwrites() bool {
+	return r.mode == blendReplace && !r.smooth()
+}
+
+// paint draws a shape's colour at (x, y), where the shape covers coverage
+// out of 255 of the pixel and c already carries that coverage in its alpha.
+// It applies the active mask and records into the mask being recorded.
+func (r *rasterCanvas) paint(x, y int, c color.RGBA, coverage uint8) {
+	mask := r.clips[len(r.clips)-1].mask
+	if mask == nil && r.recording == nil {
+		r.composite(x, y, c)
+		return
+	}
+	i := r.maskOffset(x, y)
+	if mask != nil {
+		coverage = scaleByte(coverage, mask[i])
+		c.A = scaleByte(c.A, mask[i])
+	}
+	if r.recording != nil {
+		r.recording[i] = max(r.recording[i], coverage)
+	}
+	if c.A != 0 {
+		r.composite(x, y, c)
+	}
+}
+
+func (r *rasterCanvas) maskOffset(x, y int) int {
+	b := r.img.Bounds()
+	return (y-b.Min.Y)*b.Dx() + (x - b.Min.X)
+}
+
+// scaleByte returns v scaled by f/255, rounded.
+func scaleByte(v, f uint8) uint8 {
+	return uint8((int(v)*int(f) + 127) / 255)
+}
+
+// composite draws src over the premultiplied pixel at (x, y).
+func (r *rasterCanvas) composite(x, y int, src color.RGBA) {
+	i := r.img.PixOffset(x, y)
+	r.compositePixel(r.img.Pix[i:i+4:i+4], src)
+}
+
+// compositePixel draws src over the premultiplied pixel px. Opaque normal
+// fills simply replace the pixel.
+func (r *rasterCanvas) compositePixel(px []uint8, src color.RGBA) {
+	if r.overwrites() || src.A == 255 && (r.mode == blendNormal || r.mode == blendReplace) {
+		px[0], px[1], px[2], px[3] = src.R, src.G, src.B, src.A
+		return
+	}
+	sa := float64(src.A) / 255
+	da := float64(px[3]) / 255
+	for ch, s := range [3]uint8{src.R, src.G, src.B} {
+		cs := float64(s) / 255
+		cb := float64(px[ch]) / 255
+		mixed := cs
+		if da > 0 {
+			mixed = blendChannel(r.mode, cb/da, cs)
+		}
+		px[ch] = unitToByte(sa*(1-da)*cs + sa*da*mixed + (1-sa)*cb)
+	}
+	px[3] = unitToByte(sa + da*(1-sa))
+}
+
+// fillSpan composites c over pixels x0 to x1-1 of row y, limited to area,
+// which must already lie within the clip.
+func (r *rasterCanvas) fillSpan(area image.Rectangle, y, x0, x1 int, c color.RGBA) {
+	x0, x1 = max(x0, area.Min.X), min(x1, area.Max.X)
+	if x0 >= x1 {
+		return
+	}
+	if r.clips[len(r.clips)-1].mask != nil || r.recording != nil {
+		for x := x0; x < x1; x++ {
+			r.paint(x, y, c, 255)
+		}
+		return
+	}
+	i := r.img.PixOffset(x0, y)
+	row := r.img.Pix[i : i+4*(x1-x0)]
+	if r.overwrites() || c.A == 255 && (r.mode == blendNormal || r.mode == blendReplace) {
+		row[0], row[1], row[2], row[3] = c.R, c.G, c.B, c.A
+		for n := 4; n < len(row); n *= 2 {
+			copy(row[n:], row[:n])
+		}
+		return
+	}
+	// Runs of identical backdrop pixels are common, so the last result is
+	// reused rather than compositing the same pixel again.
+	var from, to [4]uint8
+	for j := 0; j < len(row); j += 4 {
+		px := row[j : j+4 : j+4]
+		if j > 0 && [4]uint8(px) == from {
+			copy(px, to[:])
+			continue
+		}
+		from = [4]uint8(px)
+		r.compositePixel(px, c)
+		to = [4]uint8(px)
+	}
+}
+
+// ceilInt is the first integer pixel centre at or after v.
+func ceilInt(v float64) int {
+	return int(math.Ceil(v))
+}
+
+// refineSpan corrects an estimated run lo to hi inclusive of the pixels for
+// which inside holds, assuming those pixels form a single run. Estimates come
+// from closed-form solutions and may be a pixel off where rounding differs
+// from the per-pixel test; refining against that test keeps both paths
+// identical.
+func refineSpan(lo, hi int, inside func(x int) bool) (int, int) {
+	for lo <= hi && !inside(lo) {
+		lo++
+	}
+	for inside(lo - 1) {
+		lo--
+	}
+	for hi >= lo && !inside(hi) {
+		hi--
+	}
+	for inside(hi + 1) {
+		hi++
+	}
+	return lo, hi
+}
+
+func unitToByte(v float64) uint8 {
+	return uint8(math.Max(0, math.Min(255, v*255+0.5)))
+}
+
+func (r *rasterCanvas) Size() int {
+	return r.img.Bounds().Dx()
+}
+
+func (r *rasterCanvas) clip() image.Rectangle {
+	return r.clips[len(r.clips)-1].rect
+}
+
+// pixelRect returns the pixels whose centres may fall inside the given
+// canvas-space bounds, limited to the active clip.
+func (r *rasterCanvas) pixelRect(x0, y0, x1, y1 float64) image.Rectangle {
+	rect := image.Rect(
+		int(math.Floor(x0)), int(math.Floor(y0)),
+		int(math.Ceil(x1))+1, int(math.Ceil(y1))+1,
+	)
+	return rect.Intersect(r.clip())
+}
+
+func (r *rasterCanvas) fill(area image.Rectangle, inside func(x, y float64) bool, c color.RGBA) {
+	if r.smooth() {
+		r.fillCoverage(area, inside, c)
+		return
+	}
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			if inside(float64(x), float64(y)) {
+				r.paint(x, y, c, 255)
+			}
+		}
+	}
+}
+
+// fillCoverage samples inside on a grid within each pixel and scales the
+// fill's alpha by the fraction of samples that hit.
+func (r *rasterCanvas) fillCoverage(area image.Rectangle, inside func(x, y float64) bool, c color.RGBA) {
+	n := r.samples
+	step := 1 / float64(n)
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			hits := 0
+			for sy := 0; sy < n; sy++ {
+				py := float64(y) - 0.5 + (float64(sy)+0.5)*step
+				for sx := 0; sx < n; sx++ {
+					if inside(float64(x)-0.5+(float64(sx)+0.5)*step, py) {
+						hits++
+					}
+				}
+			}
+			switch hits {
+			case 0:
+			case n * n:
+				r.paint(x, y, c, 255)
+			default:
+				partial := c
+				partial.A = uint8((int(c.A)*hits + n*n/2) / (n * n))
+				r.paint(x, y, partial, uint8((255*hits+n*n/2)/(n*n)))
+			}
+		}
+	}
+}
+
+// The smooth path draws each primitive with the geometry the SVG encoder
+// emits, in which pixel (x, y) is the square around its centre: rectangles
+// and polygons end half a pixel before their last covered centre, and discs
+// reach half a pixel past it.
+
+func (r *rasterCanvas) FillRect(x0, y0, x1, y1 float64, fill color.RGBA) {
+	if r.smooth() {
+		x0, y0, x1, y1 = x0-0.5, y0-0.5, x1-0.5, y1-0.5
+	}
+	if r.spans() {
+		area := r.pixelRect(x0, y0, x1, y1)
+		for y := max(area.Min.Y, ceilInt(y0)); y < min(area.Max.Y, ceilInt(y1)); y++ {
+			r.fillSpan(area, y, ceilInt(x0), ceilInt(x1), fill)
+		}
+		return
+	}
+	r.fill(r.pixelRect(x0, y0, x1, y1), func(x, y float64) bool {
+		return x >= x0 && x < x1 && y >= y0 && y < y1
+	}, fill)
+}
+
+func (r *rasterCanvas) FillCircle(center vec, radius float64, fill color.RGBA) {
+	if r.smooth() && radius >= 0 {
+		radius += 0.5
+	}
+	r2 := radius * radius
+	area := r.pixelRect(center.X-radius, center.Y-radius, center.X+radius, center.Y+radius)
+	if r.spans() {
+		for y := area.Min.Y; y < area.Max.Y; y++ {
+			dy := float64(y) - center.Y
+			h := r2 - dy*dy
+			if h < 0 {
+				continue
+			}
+			w := math.Sqrt(h)
+			lo, hi := refineSpan(ceilInt(center.X-w), int(math.Floor(center.X+w)), func(x int) bool {
+				dx := float64(x) - center.X
+				return dx*dx+dy*dy <= r2
+			})
+			r.fillSpan(area, y, lo, hi+1, fill)
+		}
+		return
+	}
+	r.fill(area, func(x, y float64) bool {
+		dx := x - center.X
+		dy := y - center.Y
+		return dx*dx+dy*dy <= r2
+	}, fill)
+}
+
+func (r *rasterCanvas) FillEllipse(center vec, rx, ry float64, fill color.RGBA) {
+	if rx <= 0 || ry <= 0 {
+		return
+	}
+	if r.smooth() {
+		rx, ry = rx+0.5, ry+0.5
+	}
+	area := r.pixelRect(center.X-rx, center.Y-ry, center.X+rx, center.Y+ry)
+	if r.spans() {
+		for y := area.Min.Y; y < area.Max.Y; y++ {
+			dy := (float64(y) - center.Y) / ry
+			h := 1 - dy*dy
+			if h < 0 {
+				continue
+			}
+			w := rx * math.Sqrt(h)
+			lo, hi := refineSpan(ceilInt(center.X-w), int(math.Floor(center.X+w)), func(x int) bool {
+				dx := (float64(x) - center.X) / rx
+				return dx*dx+dy*dy <= 1
+			})
+			r.fillSpan(area, y, lo, hi+1, fill)
+		}
+		return
+	}
+	r.fill(area, func(x, y float64) bool {
+		dx := (x - center.X) / rx
+		dy := (y - center.Y) / ry
+		return dx*dx+dy*dy <= 1
+	}, fill)
+}
+
+func (r *rasterCanvas) FillPolygon(points []vec, fill color.RGBA) {
+	if len(points) < 3 {
+		return
+	}
+	if r.smooth() {
+		shifted := make([]vec, len(points))
+		for i, p := range points {
+			shifted[i] = vec{X: p.X - 0.5, Y: p.Y - 0.5}
+		}
+		points = shifted
+	}
+	x0, y0, x1, y1 := pointBounds(points)
+	area := r.pixelRect(x0, y0, x1, y1)
+	if r.spans() {
+		r.fillPolygonSpans(area, points, fill)
+		return
+	}
+	r.fill(area, func(x, y float64) bool {
+		return insidePolygon(points, x, y)
+	}, fill)
+}
+
+// fillPolygonSpans applies insidePolygon's even-odd rule a row at a time: a
+// pixel is inside when an odd number of edge crossings lie to its right.
+func (r *rasterCanvas) fillPolygonSpans(area image.Rectangle, points []vec, fill color.RGBA) {
+	crossings := make([]int, 0, len(points))
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		fy := float64(y)
+		crossings = crossings[:0]
+		j := len(points) - 1
+		for i := range points {
+			a, b := points[i], points[j]
+			if (a.Y <= fy) != (b.Y <= fy) {
+				// x < cross holds for exactly the pixels before ceil(cross).
+				crossings = append(crossings, ceilInt(a.X+(fy-a.Y)*(b.X-a.X)/(b.Y-a.Y)))
+			}
+			j = i
+		}
+		slices.Sort(crossings)
+		for k := 1; k < len(crossings); k++ {
+			if (len(crossings)-k)%2 == 1 {
+				r.fillSpan(area, y, crossings[k-1], crossings[k], fill)
+			}
+		}
+		if len(crossings)%2 == 1 {
+			r.fillSpan(area, y, area.Min.X, crossings[0], fill)
+		}
+	}
+}
+
+func (r *rasterCanvas) StrokePolyline(points []vec, width float64, stroke color.RGBA) {
+	if len(points) == 0 || width <= 0 {
+		return
+	}
+	half := width / 2
+	x0, y0, x1, y1 := pointBounds(points)
+	area := r.pixelRect(x0-half, y0-half, x1+half, y1+half)
+	if r.spans() {
+		r.strokeSpans(area, points, half, stroke)
+		return
+	}
+	r.fill(area, func(x, y float64) bool {
+		return polylineDistance2(points, x, y) <= half*half
+	}, stroke)
+}
+
+// strokeSpans marks the pixels of each row within half of any segment,
+// testing only pixels near each segment, and then fills the marked runs so
+// overlapping segments composite every pixel once.
+func (r *rasterCanvas) strokeSpans(area image.Rectangle, points []vec, half float64, stroke color.RGBA) {
+	if area.Empty() {
+		return
+	}
+	segments := len(points) - 1
+	if segments == 0 {
+		// A lone point is a zero-length segment, which segmentDistance2
+		// measures exactly as polylineDistance2 does.
+		segments, points = 1, []vec{points[0], points[0]}
+	}
+	covered := make([]bool, area.Dx())
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		fy := float64(y)
+		clear(covered)
+		for i := 1; i <= segments; i++ {
+			a, b := points[i-1], points[i]
+			// The bounds are a pixel wider than the stroke so rounding in
+			// the distance test never decides a pixel that is not tested.
+			if fy < math.Min(a.Y, b.Y)-half-1 || fy > math.Max(a.Y, b.Y)+half+1 {
+				continue
+			}
+			from := max(area.Min.X, int(math.Floor(math.Min(a.X, b.X)-half))-1)
+			to := min(area.Max.X-1, ceilInt(math.Max(a.X, b.X)+half)+1)
+			for x := from; x <= to; x++ {
+				if !covered[x-area.Min.X] && segmentDistance2(a, b, float64(x), fy) <= half*half {
+					covered[x-area.Min.X] = true
+				}
+			}
+		}
+		for x := 0; x < len(covered); {
+			if !covered[x] {
+				x++
+				continue
+			}
+			start := x
+			for x < len(covered) && covered[x] {
+				x++
+			}
+			r.fillSpan(area, y, area.Min.X+start, area.Min.X+x, stroke)
+		}
+	}
+}
+
+// FillVerticalGradient fills row by row, with each row's colour taken at
+// its pixel centre.
+func (r *rasterCanvas) FillVerticalGradient(x0, y0, x1, y1 float64, top, bottom color.RGBA) {
+	start, height := y0, y1-y0
+	if r.smooth() {
+		x0, y0, x1, y1 = x0-0.5, y0-0.5, x1-0.5, y1-0.5
+	}
+	inside := func(x, y float64) bool {
+		return x >= x0 && x < x1 && y >= y0 && y < y1
+	}
+	area := r.pixelRect(x0, y0, x1, y1)
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		t := math.Max(0, math.Min(1, (float64(y)-start)/height))
+		if !r.spans() {
+			r.fill(image.Rect(area.Min.X, y, area.Max.X, y+1), inside, lerpColor(top, bottom, t))
+		} else if float64(y) >= y0 && float64(y) < y1 {
+			r.fillSpan(area, y, ceilInt(x0), ceilInt(x1), lerpColor(top, bottom, t))
+		}
+	}
+}
+
+func (r *rasterCanvas) PushClipRect(x0, y0, x1, y1 float64) {
+	rect := image.Rect(
+		int(math.Ceil(x0)), int(math.Ceil(y0)),
+		int(math.Ceil(x1)), int(math.Ceil(y1)),
+	)
+	r.clips = append(r.clips, rasterClip{rect: rect.Intersect(r.clip()), mask: r.clips[len(r.clips)-1].mask})
+}
+
+// PushMask combines the named mask with any mask already active, so nested
+// masks intersect.
+func (r *rasterCanvas) PushMask(name string, invert bool) {
+	recorded := r.masks[name]
+	outer := r.clips[len(r.clips)-1]
+	mask := make([]uint8, r.img.Bounds().Dx()*r.img.Bounds().Dy())
+	for i := range mask {
+		var m uint8
+		if recorded != nil {
+			m = recorded[i]
+		}
+		if invert {
+			m = 255 - m
+		}
+		if outer.mask != nil {
+			m = scaleByte(m, outer.mask[i])
+		}
+		mask[i] = m
+	}
+	r.clips = append(r.clips, rasterClip{rect: outer.rect, mask: mask})
+}
+
+func (r *rasterCanvas) BeginMask(name string) {
+	r.recording = make([]uint8, r.img.Bounds().Dx()*r.img.Bounds().Dy())
+	r.recordingName = name
+}
+
+func (r *rasterCanvas) EndMask() {
+	if r.recording == nil {
+		return
+	}
+	if r.masks == nil {
+		r.masks = map[string][]uint8{}
+	}
+	r.masks[r.recordingName] = r.recording
+	r.recording, r.recordingName = nil, ""
+}
+
+func (r *rasterCanvas) PopClip() {
+	if len(r.clips) > 1 {
+		r.clips = r.clips[:len(r.clips)-1]
+	}
+}
+
+// Vignette darkens pixels further than radius from center. Each row skips
+// the run of pixels well inside the radius, and pixels only just inside are
+// ruled out without a square root, which leaves the exact comparison to the
+// pixels near the edge.
+func (r *rasterCanvas) Vignette(center vec, radius float64) {
+	bounds := r.img.Bounds()
+	inner2 := radius * radius * (1 - 1e-9)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		dy := float64(y) - center.Y
+		row := r.img.Pix[r.img.PixOffset(bounds.Min.X, y):]
+		skipFrom, skipTo := bounds.Max.X, bounds.Max.X
+		if h := inner2 - dy*dy; h > 0 {
+			w := math.Sqrt(h) - 1
+			skipFrom, skipTo = max(bounds.Min.X, ceilInt(center.X-w)), int(math.Floor(center.X+w))+1
+		}
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if x == skipFrom && skipFrom < skipTo {
+				x = skipTo - 1
+				continue
+			}
+			dx := float64(x) - center.X
+			d2 := dx*dx + dy*dy
+			if d2 <= inner2 {
+				continue
+			}
+			dist := math.Sqrt(d2)
+			if dist > radius {
+				px := row[4*(x-bounds.Min.X):]
+				factor := math.Min((dist-radius)/radius, vignetteStrength)
+				px[0] = uint8(float64(px[0]) * (1 - factor))
+				px[1] = uint8(float64(px[1]) * (1 - factor))
+				px[2] = uint8(float64(px[2]) * (1 - factor))
+			}
+		}
+	}
+}
+
+// Noise shifts the colour channels of each speck, never past its alpha, so
+// specks on translucent pixels stay valid premultiplied colour. Pixels drawn
+// in replace mode hold straight colour, so there specks are only kept in
+// the channel range.
+func (r *rasterCanvas) Noise(rng randStream, intensity int) {
+	r.noise(rng, r.Size(), 1, intensity)
+}
+
+// noise lays the specks out on a size by size grid drawn scale times larger,
+// so a speck covers the pixels whose centres fall inside it, as a FillRect
+// of the same bounds would.
+func (r *rasterCanvas) noise(rng randStream, size int, scale float64, intensity int) {
+	unit := pixelUnit(size)
+	bounds := r.img.Bounds()
+	edge := func(v int) int { return ceilInt(float64(v)*scale - 0.5) }
+	eachNoiseSpeck(rng, size, unit, intensity, func(x, y, shift int) {
+		speck := image.Rect(edge(x), edge(y), edge(x+unit), edge(y+unit)).Intersect(bounds)
+		for py := speck.Min.Y; py < speck.Max.Y; py++ {
+			i := r.img.PixOffset(speck.Min.X, py)
+			row := r.img.Pix[i : i+4*speck.Dx()]
+			for j := 0; j < len(row); j += 4 {
+				alpha := int(row[j+3])
+				if r.overwrites() {
+					alpha = 255
+				}
+				row[j] = clampChannel(min(int(row[j])+shift, alpha))
+				row[j+1] = clampChannel(min(int(row[j+1])+shift, alpha))
+				row[j+2] = clampChannel(min(int(row[j+2])+shift, alpha))
+			}
+		}
+	})
+}
+
+// Crop scales every pixel, colour and alpha alike, by how much of it lies
+// inside shape.
+func (r *rasterCanvas) Crop(shape cropShape) {
+	bounds := r.img.Bounds()
+	size := r.Size()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			coverage := cropCoverage(shape, size, x-bounds.Min.X, y-bounds.Min.Y)
+			if coverage >= 1 {
+				continue
+			}
+			f := uint8(math.Round(coverage * 255))
+			px := r.img.Pix[r.img.PixOffset(x, y):]
+			px[0], px[1], px[2], px[3] = scaleByte(px[0], f), scaleByte(px[1], f), scaleByte(px[2], f), scaleByte(px[3], f)
+		}
+	}
+}
+
+const vignetteStrength = 0.6
+
+// eachNoiseSpeck draws the noise positions from rng. Both canvases call it so
+// the stream is consumed identically whether or not the speck is rendered.
+func eachNoiseSpeck(rng randStream, size int, unit int, intensity int, speck func(x, y, shift int)) {
+	if intensity <= 0 {
+		return
+	}
+	for i := 0; i < intensity*intensity; i++ {
+		x := rng.nextInt(size/unit) * unit
+		y := rng.nextInt(size/unit) * unit
+		shift := rng.nextInt(5) - 2
+		speck(x, y, shift)
+	}
+}
+
+func lerpColor(a color.RGBA, b color.RGBA, t float64) color.RGBA {
+	return color.RGBA{
+		R: uint8(float64(a.R)*(1-t) + float64(b.R)*t),
+		G: uint8(float64(a.G)*(1-t) + float64(b.G)*t),
+		B: uint8(float64(a.B)*(1-t) + float64(b.B)*t),
+		A: 255,
+	}
+}
+
+func pointBounds(points []vec) (x0, y0, x1, y1 float64) {
+	x0, y0 = points[0].X, points[0].Y
+	x1, y1 = x0, y0
+	for _, p := range points[1:] {
+		x0 = math.Min(x0, p.X)
+		y0 = math.Min(y0, p.Y)
+		x1 = math.Max(x1, p.X)
+		y1 = math.Max(y1, p.Y)
+	}
+	return x0, y0, x1, y1
+}
+
+// insidePolygon is an even-odd crossing test. Points on a left or top edge
+// are inside and points on a right or bottom edge are outside, which matches
+// the half-open convention of FillRect.
+func insidePolygon(points []vec, x, y float64) bool {
+	inside := false
+	j := len(points) - 1
+	for i := range points {
+		a, b := points[i], points[j]
+		if (a.Y <= y) != (b.Y <= y) {
+			cross := a.X + (y-a.Y)*(b.X-a.X)/(b.Y-a.Y)
+			if x < cross {
+				inside = !inside
+			}
+		}
+		j = i
+	}
+	return inside
+}
+
+func polylineDistance2(points []vec, x, y float64) float64 {
+	if len(points) == 1 {
+		dx := x - points[0].X
+		dy := y - points[0].Y
+		return dx*dx + dy*dy
+	}
+	best := math.Inf(1)
+	for i := 1; i < len(points); i++ {
+		best = math.Min(best, segmentDistance2(points[i-1], points[i], x, y))
+	}
+	return best
+}
+
+func segmentDistance2(a vec, b vec, x, y float64) float64 {
+	abx := b.X - a.X
+	aby := b.Y - a.Y
+	t := 0.0
+	if l2 := abx*abx + aby*aby; l2 > 0 {
+		t = math.Max(0, math.Min(1, ((x-a.X)*abx+(y-a.Y)*aby)/l2))
+	}
+	dx := x - (a.X + t*abx)
+	dy := y - (a.Y + t*aby)
+	return dx*dx + dy*dy
+}
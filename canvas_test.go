@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"maps"
+	"math"
+	"strconv"
+	"testing"
+)
+
+// patternImage fills an opaque image with a pattern that exercises every
+// channel value.
+func patternImage(size int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = uint8(i*7), uint8(i*13), uint8(i*29), 255
+	}
+	return img
+}
+
+func TestVignetteLayerMatchesBaseline(t *testing.T) {
+	vignette, _ := findLayer("vignette")
+	for _, size := range []int{16, 37, 64, 100, 128, 256, 512} {
+		want := patternImage(size)
+		baselineApplyVignette(want, image.Point{X: size / 2, Y: size / 2}, int(float64(size)*0.48))
+
+		got := patternImage(size)
+		vignette.Draw(newRasterCanvas(got), &avatarTraits{size: size, center: image.Point{X: size / 2, Y: size / 2}})
+		if !bytes.Equal(got.Pix, want.Pix) {
+			t.Errorf("size %d: vignette differs from the baseline", size)
+		}
+	}
+}
+
+func TestReplaceOverwritesCrispPixels(t *testing.T) {
+	backdrop := color.RGBA{R: 200, G: 200, B: 200, A: 255}
+	shadow := color.RGBA{R: 90, G: 72, B: 62, A: 120}
+	for _, samples := range []int{1, corpusSamples} {
+		c := newSmoothRasterCanvas(image.NewRGBA(image.Rect(0, 0, 4, 4)), samples)
+		c.FillRect(0, 0, 4, 4, backdrop)
+		c.SetBlendMode(blendReplace)
+		c.FillRect(0, 0, 4, 4, shadow)
+		got := c.img.RGBAAt(1, 1)
+		if samples == 1 && got != shadow {
+			t.Errorf("crisp replace drew %v, want %v", got, shadow)
+		}
+		if samples > 1 && got.A != 255 {
+			t.Errorf("smooth replace drew %v, want it composited over the backdrop", got)
+		}
+	}
+}
+
+// referenceCanvas is the original per-pixel rasteriser: every shape tests
+// each pixel centre, and the vignette and noise visit every pixel.
+type referenceCanvas struct {
+	*rasterCanvas
+}
+
+func newReferenceCanvas(img *image.RGBA, samples int) referenceCanvas {
+	r := newSmoothRasterCanvas(img, samples)
+	r.reference = true
+	return referenceCanvas{r}
+}
+
+func (r referenceCanvas) Vignette(center vec, radius float64) {
+	bounds := r.img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			dx := float64(x) - center.X
+			dy := float64(y) - center.Y
+			dist := math.Sqrt(dx*dx + dy*dy)
+			if dist > radius {
+				pixel := r.img.RGBAAt(x, y)
+				factor := math.Min((dist-radius)/radius, vignetteStrength)
+				r.img.SetRGBA(x, y, color.RGBA{
+					R: uint8(float64(pixel.R) * (1 - factor)),
+					G: uint8(float64(pixel.G) * (1 - factor)),
+					B: uint8(float64(pixel.B) * (1 - factor)),
+					A: pixel.A,
+				})
+			}
+		}
+	}
+}
+
+func (r referenceCanvas) Noise(rng randStream, intensity int) {
+	unit := pixelUnit(r.Size())
+	eachNoiseSpeck(rng, r.Size(), unit, intensity, func(x, y, shift int) {
+		for dy := 0; dy < unit; dy++ {
+			for dx := 0; dx < unit; dx++ {
+				p := r.img.RGBAAt(x+dx, y+dy)
+				alpha := int(p.A)
+				if r.overwrites() {
+					alpha = 255
+				}
+				r.img.SetRGBA(x+dx, y+dy, color.RGBA{
+					R: clampChannel(min(int(p.R)+shift, alpha)),
+					G: clampChannel(min(int(p.G)+shift, alpha)),
+					B: clampChannel(min(int(p.B)+shift, alpha)),
+					A: p.A,
+				})
+			}
+		}
+	})
+}
+
+func TestRasteriserMatchesReference(t *testing.T) {
+	inputs, sizes := corpusInputs, corpusSizes
+	if testing.Short() {
+		inputs, sizes = inputs[:2], []int{37}
+	}
+	for _, v := range publishedVersions {
+		p, err := v.pipeline(layerConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, input := range inputs {
+			for _, size := range sizes {
+				for _, samples := range []int{1, corpusSamples} {
+					tr := p.traits(hashInput(input, corpusTimeKey), size)
+					fast := newSmoothRasterCanvas(image.NewRGBA(image.Rect(0, 0, size, size)), samples)
+					ref := newReferenceCanvas(image.NewRGBA(image.Rect(0, 0, size, size)), samples)
+					for _, l := range p.layers {
+						p.drawLayer(fast, l, tr)
+						p.drawLayer(ref, l, tr)
+						if !bytes.Equal(fast.img.Pix, ref.img.Pix) {
+							t.Fatalf("v%d %q %dpx %d samples: layer %s differs from the reference", v.number, input, size, samples, l.Name())
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// BenchmarkLayers times each layer of the latest version, drawn onto what
+// the layers below it left, with the span rasteriser and the reference.
+func BenchmarkLayers(b *testing.B) {
+	const size = 256
+	v := publishedVersions[len(publishedVersions)-1]
+	p, err := v.pipeline(layerConfig{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	tr := p.traits(hashInput("avatargenerator bench", corpusTimeKey), size)
+
+	backdrop := newRasterCanvas(image.NewRGBA(image.Rect(0, 0, size, size)))
+	for _, l := range p.layers {
+		pix := bytes.Clone(backdrop.img.Pix)
+		masks := backdrop.masks
+		for _, reference := range []bool{false, true} {
+			name := l.Name() + "/spans"
+			if reference {
+				name = l.Name() + "/reference"
+			}
+			b.Run(name, func(b *testing.B) {
+				r := newRasterCanvas(image.NewRGBA(image.Rect(0, 0, size, size)))
+				copy(r.img.Pix, pix)
+				r.masks = maps.Clone(masks)
+				var c canvas = r
+				if reference {
+					r.reference = true
+					c = referenceCanvas{r}
+				}
+				for i := 0; i < b.N; i++ {
+					p.drawLayer(c, l, tr)
+				}
+			})
+		}
+		p.drawLayer(backdrop, l, tr)
+	}
+}
+
+// BenchmarkRender times whole renders at a spread of sizes.
+func BenchmarkRender(b *testing.B) {
+	p := activePipelines[cfg.defaultVersion]
+	hash := hashInput("avatargenerator bench", corpusTimeKey)
+	for _, size := range []int{64, 256} {
+		for _, samples := range []int{1, corpusSamples} {
+			b.Run(strconv.Itoa(size)+"px/"+strconv.Itoa(samples)+"x", func(b *testing.B) {
+				img := image.NewRGBA(image.Rect(0, 0, size, size))
+				for i := 0; i < b.N; i++ {
+					p.render(newSmoothRasterCanvas(img, samples), hash)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+type config struct {
+	addr            string
+	socket          string
+	readTimeout     time.Duration
+	writeTimeout    time.Duration
+	idleTimeout     time.Duration
+	shutdownTimeout time.Duration
+	drainDelay      time.Duration
+	selfTestEvery   time.Duration
+
+	logLevel  slog.Level
+	logOutput string
+	logKey    []byte
+
+	minSize  int
+	maxSize  int
+	rotation rotationPeriod
+	location *time.Location
+
+	// batchLimit caps the items in one batch. Rate limiting charges a batch
+	// a token per item, so with it on the limit must fit in rateBurst.
+	batchLimit int
+
+	requireSignatures bool
+	signingKeys       [][]byte
+	apiKeys           [][]byte
+
+	layers         layerConfig
+	defaultVersion int
+	antialias      bool
+	aaSamples      int
+
+	corsOrigins []string
+	corsMaxAge  time.Duration
+
+	rateLimit       float64
+	rateBurst       int
+	rateLimitKey    rateLimitKey
+	forwardedHeader string
+}
+
+var cfg = config{
+	addr:            ":8080",
+	readTimeout:     10 * time.Second,
+	writeTimeout:    30 * time.Second,
+	idleTimeout:     2 * time.Minute,
+	shutdownTimeout: 30 * time.Second,
+	drainDelay:      5 * time.Second,
+	selfTestEvery:   time.Minute,
+
+	logLevel:  slog.LevelInfo,
+	logOutput: "stderr",
+
+	minSize:  16,
+	maxSize:  512,
+	rotation: rotateDaily,
+	location: time.UTC,
+
+	batchLimit: 256,
+
+	defaultVersion: 1,
+	aaSamples:      4,
+
+	corsMaxAge: 10 * time.Minute,
+
+	rateBurst:       20,
+	rateLimitKey:    rateKeyIP,
+	forwardedHeader: "X-Forwarded-For",
+}
+
+// loadEnv applies environment overrides. It runs before flags are
+// registered, so the environment changes the defaults and flags still win.
+func (c *config) loadEnv() {
+	if addr, ok := os.LookupEnv("AVATAR_ADDR"); ok {
+		c.addr = addr
+	}
+	if socket, ok := os.LookupEnv("AVATAR_SOCKET"); ok {
+		c.socket = socket
+	}
+	c.logKey = []byte(os.Getenv(logKeyEnv))
+}
+
+func (c *config) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.addr, "addr", c.addr, "TCP listen address, empty to disable (env AVATAR_ADDR)")
+	fs.StringVar(&c.socket, "socket", c.socket, "Unix domain socket to listen on as well (env AVATAR_SOCKET)")
+	fs.DurationVar(&c.readTimeout, "read-timeout", c.readTimeout, "maximum time to read a request, including the body")
+	fs.DurationVar(&c.writeTimeout, "write-timeout", c.writeTimeout, "maximum time to render and write a response")
+	fs.DurationVar(&c.idleTimeout, "idle-timeout", c.idleTimeout, "how long keep-alive connections may sit idle")
+	fs.DurationVar(&c.drainDelay, "drain-delay", c.drainDelay, "how long SIGTERM or SIGINT reports not ready before the server stops accepting connections")
+	fs.DurationVar(&c.shutdownTimeout, "shutdown-timeout", c.shutdownTimeout, "how long SIGTERM or SIGINT waits for requests in flight")
+	fs.DurationVar(&c.selfTestEvery, "self-test-interval", c.selfTestEvery, "how often /readyz re-runs the smoke render self-test; 0 runs it only at startup")
+	fs.Func("log-level", "minimum log level: debug, info, warn or error (default info)", func(raw string) error {
+		level, err := parseLogLevel(raw)
+		c.logLevel = level
+		return err
+	})
+	fs.StringVar(&c.logOutput, "log-output", c.logOutput, "where JSON logs go: stderr, stdout or a file path; inputs are only logged as an HMAC keyed by "+logKeyEnv)
+	fs.IntVar(&c.minSize, "min-size", c.minSize, "smallest accepted avatar size in pixels")
+	fs.IntVar(&c.maxSize, "max-size", c.maxSize, "largest accepted avatar size in pixels")
+	fs.IntVar(&c.batchLimit, "batch-limit", c.batchLimit, "maximum number of avatars in one POST /avatars request; with -rate-limit set it must not exceed -rate-burst, as each avatar costs a token")
+	fs.BoolVar(&c.requireSignatures, "require-signatures", c.requireSignatures, "reject avatar requests without a valid sig parameter (keys come from "+signingKeysEnv+")")
+	fs.Func("disable-layers", "comma-separated avatar layers to leave out, e.g. hood,scar", func(raw string) error {
+		c.layers.disabled = parseNameList(raw)
+		return nil
+	})
+	fs.Func("layer-z", "comma-separated name:z overrides of the layer drawing order, e.g. hood:95", func(raw string) error {
+		z, err := parseLayerZ(raw)
+		c.layers.z = z
+		return err
+	})
+	fs.Func("layer-blend", "comma-separated name:mode overrides of layer blend modes (normal, multiply, screen or overlay), e.g. blush:multiply", func(raw string) error {
+		blend, err := parseLayerBlend(raw)
+		c.layers.blend = blend
+		return err
+	})
+	fs.Func("layer-clip", "comma-separated name:mask clips of layers to an earlier layer, or name:!mask to its outside, e.g. hair:head", func(raw string) error {
+		clip, err := parseLayerClip(raw)
+		c.layers.clip = clip
+		return err
+	})
+	fs.IntVar(&c.defaultVersion, "default-version", c.defaultVersion, "algorithm version for requests without v=; existing avatars change if this is raised")
+	fs.BoolVar(&c.antialias, "antialias", c.antialias, "anti-alias avatars unless the request sets aa=off")
+	fs.IntVar(&c.aaSamples, "aa-samples", c.aaSamples, "supersampling factor per axis for anti-aliased PNGs")
+	fs.Func("cors-origins", "comma-separated origins allowed to read responses cross-origin, or * for any (default none)", func(raw string) error {
+		c.corsOrigins = parseOrigins(raw)
+		return nil
+	})
+	fs.DurationVar(&c.corsMaxAge, "cors-max-age", c.corsMaxAge, "how long browsers may cache a CORS preflight response")
+	fs.Float64Var(&c.rateLimit, "rate-limit", c.rateLimit, "avatar requests per second each client may sustain; 0, the default, disables rate limiting")
+	fs.IntVar(&c.rateBurst, "rate-burst", c.rateBurst, "avatar requests a client may make at once before being limited")
+	fs.Func("rate-limit-key", "what identifies a client: ip, api-key ("+apiKeyHeader+" header, for keys listed in "+apiKeysEnv+") or forwarded (the -forwarded-header set by a trusted proxy) (default ip)", func(raw string) error {
+		key, err := parseRateLimitKey(raw)
+		c.rateLimitKey = key
+		return err
+	})
+	fs.StringVar(&c.forwardedHeader, "forwarded-header", c.forwardedHeader, "header carrying the client address when -rate-limit-key=forwarded")
+	fs.Func("rotation", "default rotation period: never, hourly, daily, weekly, monthly or yearly (default daily)", func(raw string) error {
+		period, err := parseRotation(raw)
+		c.rotation = period
+		return err
+	})
+	fs.Func("timezone", "IANA timezone in which rotation periods start (default UTC)", func(raw string) error {
+		loc, err := time.LoadLocation(raw)
+		c.location = loc
+		return err
+	})
+}
+
+func (c config) validate() error {
+	if c.addr == "" && c.socket == "" {
+		return errors.New("at least one of addr and socket must be set")
+	}
+	if c.readTimeout < 0 || c.writeTimeout < 0 || c.idleTimeout < 0 || c.shutdownTimeout < 0 || c.drainDelay < 0 || c.selfTestEvery < 0 {
+		return errors.New("timeouts must not be negative")
+	}
+	if c.minSize < 8 {
+		return fmt.Errorf("min-size must be at least 8, got %d", c.minSize)
+	}
+	if c.maxSize < c.minSize {
+		return fmt.Errorf("max-size %d is smaller than min-size %d", c.maxSize, c.minSize)
+	}
+	if c.maxSize > 4096 {
+		return fmt.Errorf("max-size must be at most 4096, got %d", c.maxSize)
+	}
+	if defaultSize < c.minSize || defaultSize > c.maxSize {
+		return fmt.Errorf("size range %d-%d must include the default size %d", c.minSize, c.maxSize, defaultSize)
+	}
+	if c.batchLimit < 1 {
+		return fmt.Errorf("batch-limit must be positive, got %d", c.batchLimit)
+	}
+	if _, ok := findVersion(c.defaultVersion); !ok {
+		return fmt.Errorf("default-version %d is not published, published versions are %s", c.defaultVersion, publishedVersionList())
+	}
+	if c.aaSamples < 2 || c.aaSamples > 16 {
+		return fmt.Errorf("aa-samples must be between 2 and 16, got %d", c.aaSamples)
+	}
+	if c.rateLimit < 0 {
+		return fmt.Errorf("rate-limit must not be negative, got %g", c.rateLimit)
+	}
+	if c.rateLimit > 0 && c.rateBurst < 1 {
+		return fmt.Errorf("rate-burst must be positive, got %d", c.rateBurst)
+	}
+	if c.rateLimit > 0 && c.batchLimit > c.rateBurst {
+		return fmt.Errorf("batch-limit %d is larger than rate-burst %d, and batches are charged a token per item", c.batchLimit, c.rateBurst)
+	}
+	if c.rateLimit > 0 && c.rateLimitKey == rateKeyAPIKey && len(c.apiKeys) == 0 {
+		return fmt.Errorf("rate-limit-key api-key needs at least one key in %s", apiKeysEnv)
+	}
+	if c.requireSignatures && len(c.signingKeys) == 0 {
+		return fmt.Errorf("require-signatures needs at least one key in %s", signingKeysEnv)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// corsExposedHeaders are the response headers scripts on other origins may
+// read. Everything else beyond the CORS-safelisted set stays hidden.
+var corsExposedHeaders = []string{
+	"ETag",
+	"X-Avatar-Hash",
+	"X-Avatar-Time-Key",
+	"X-Avatar-Version",
+	"RateLimit-Policy",
+	"RateLimit-Limit",
+	"RateLimit-Remaining",
+	"RateLimit-Reset",
+	"Retry-After",
+}
+
+var corsAllowedHeaders = []string{"Content-Type", "If-None-Match", "If-Modified-Since", apiKeyHeader}
+
+func parseOrigins(raw string) []string {
+	var origins []string
+	for _, origin := range strings.Split(raw, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, strings.TrimSuffix(origin, "/"))
+		}
+	}
+	return origins
+}
+
+func originAllowed(origin string) bool {
+	return slices.Contains(cfg.corsOrigins, "*") || slices.Contains(cfg.corsOrigins, origin)
+}
+
+// withCORS adds CORS headers for the configured origins and answers
+// preflight requests before they reach the method-specific routes.
+func withCORS(next http.Handler) http.Handler {
+	if len(cfg.corsOrigins) == 0 {
+		return next
+	}
+	exposed := strings.Join(corsExposedHeaders, ", ")
+	allowed := strings.Join(corsAllowedHeaders, ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		header.Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !originAllowed(origin) {
+			if preflight {
+				http.Error(w, "origin not allowed", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if slices.Contains(cfg.corsOrigins, "*") {
+			header.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			header.Set("Access-Control-Allow-Origin", origin)
+		}
+		if !preflight {
+			header.Set("Access-Control-Expose-Headers", exposed)
+			next.ServeHTTP(w, r)
+			return
+		}
+		header.Add("Vary", "Access-Control-Request-Method")
+		header.Add("Vary", "Access-Control-Request-Headers")
+		header.Set("Access-Control-Allow-Methods", "GET, HEAD, POST")
+		header.Set("Access-Control-Allow-Headers", allowed)
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.corsMaxAge.Seconds())))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
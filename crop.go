@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// cropShape is the outline a finished avatar is cut to. Square leaves the
+// image as drawn.
+type cropShape string
+
+const (
+	cropSquare   cropShape = "square"
+	cropCircle   cropShape = "circle"
+	cropSquircle cropShape = "squircle"
+	cropRounded  cropShape = "rounded"
+)
+
+// roundedCornerRatio is the corner radius of the rounded crop as a fraction
+// of the image size.
+const roundedCornerRatio = 0.15
+
+func parseCropShape(raw string) (cropShape, error) {
+	switch shape := cropShape(strings.ToLower(raw)); shape {
+	case cropSquare, cropCircle, cropSquircle, cropRounded:
+		return shape, nil
+	}
+	return "", fmt.Errorf("invalid shape %q, want circle, squircle, rounded or square", raw)
+}
+
+// crops reports whether the shape cuts anything away.
+func (s cropShape) crops() bool {
+	return s != "" && s != cropSquare
+}
+
+// cropDistance is the signed distance in pixels from (x, y) in canvas space
+// to the edge of the shape cut from a size by size image, negative inside.
+// The squircle's distance is approximate but exact enough at its edge.
+func cropDistance(shape cropShape, size int, x, y float64) float64 {
+	half := float64(size) / 2
+	dx := math.Abs(x + 0.5 - half)
+	dy := math.Abs(y + 0.5 - half)
+	switch shape {
+	case cropCircle:
+		return math.Hypot(dx, dy) - half
+	case cropSquircle:
+		return half * (math.Pow(math.Pow(dx/half, 4)+math.Pow(dy/half, 4), 0.25) - 1)
+	case cropRounded:
+		r := roundedCornerRatio * float64(size)
+		qx, qy := dx-(half-r), dy-(half-r)
+		return math.Hypot(math.Max(qx, 0), math.Max(qy, 0)) + math.Min(math.Max(qx, qy), 0) - r
+	}
+	return math.Max(dx, dy) - half
+}
+
+// cropCoverage is how much of the pixel at (x, y) lies inside the shape.
+func cropCoverage(shape cropShape, size int, x, y int) float64 {
+	return math.Max(0, math.Min(1, 0.5-cropDistance(shape, size, float64(x), float64(y))))
+}
+
+const squirclePoints = 96
+
+// squircleOutline returns the squircle cut from a size by size image as a
+// polygon in image space, where pixel edges fall on integers.
+func squircleOutline(size int) []vec {
+	half := float64(size) / 2
+	points := make([]vec, squirclePoints)
+	for i := range points {
+		sin, cos := math.Sincos(2 * math.Pi * float64(i) / squirclePoints)
+		points[i] = vec{
+			X: half + half*math.Copysign(math.Sqrt(math.Abs(cos)), cos),
+			Y: half + half*math.Copysign(math.Sqrt(math.Abs(sin)), sin),
+		}
+	}
+	return points
+}
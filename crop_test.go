@@ -0,0 +1,110 @@
+package main
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+func TestParseCropShape(t *testing.T) {
+	for _, tc := range []struct {
+		raw  string
+		want cropShape
+		ok   bool
+	}{
+		{"circle", cropCircle, true},
+		{"Squircle", cropSquircle, true},
+		{"rounded", cropRounded, true},
+		{"square", cropSquare, true},
+		{"hexagon", "", false},
+		{"", "", false},
+	} {
+		got, err := parseCropShape(tc.raw)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("parseCropShape(%q) = %q, %v", tc.raw, got, err)
+		}
+	}
+}
+
+func TestCropCoverage(t *testing.T) {
+	const size = 64
+	for _, tc := range []struct {
+		shape   cropShape
+		x, y    int
+		covered float64
+	}{
+		{cropCircle, 32, 32, 1},
+		{cropCircle, 0, 0, 0},
+		{cropCircle, 32, 1, 1},
+		{cropCircle, 8, 8, 0},
+		{cropSquircle, 0, 0, 0},
+		{cropSquircle, 4, 4, 0},
+		{cropSquircle, 6, 6, 1},
+		{cropSquircle, 32, 0, 1},
+		{cropRounded, 0, 0, 0},
+		{cropRounded, 3, 3, 1},
+		{cropRounded, 0, 32, 1},
+		{cropSquare, 0, 0, 1},
+		{cropSquare, 63, 63, 1},
+	} {
+		if got := cropCoverage(tc.shape, size, tc.x, tc.y); math.Abs(got-tc.covered) > 1e-6 {
+			t.Errorf("%s (%d, %d): coverage %v, want %v", tc.shape, tc.x, tc.y, got, tc.covered)
+		}
+	}
+
+	// Every shape is symmetric about both axes and both diagonals.
+	for _, shape := range []cropShape{cropCircle, cropSquircle, cropRounded} {
+		for y := 0; y < size; y++ {
+			for x := 0; x < size; x++ {
+				c := cropCoverage(shape, size, x, y)
+				for _, m := range [][2]int{{size - 1 - x, y}, {x, size - 1 - y}, {y, x}} {
+					if other := cropCoverage(shape, size, m[0], m[1]); math.Abs(other-c) > 1e-9 {
+						t.Fatalf("%s: (%d, %d) has coverage %v but its mirror (%d, %d) has %v", shape, x, y, c, m[0], m[1], other)
+					}
+				}
+			}
+		}
+	}
+}
+
+// TestSquircleOutline checks the SVG squircle lies on the edge the raster
+// crop measures its distance from.
+func TestSquircleOutline(t *testing.T) {
+	for _, size := range []int{16, 64, 256} {
+		for _, p := range squircleOutline(size) {
+			if d := cropDistance(cropSquircle, size, p.X-0.5, p.Y-0.5); math.Abs(d) > 1e-9*float64(size) {
+				t.Errorf("%dpx: outline point %v is %v from the edge", size, p, d)
+			}
+		}
+	}
+}
+
+func TestRasterCrop(t *testing.T) {
+	const size = 48
+	for _, shape := range []cropShape{cropCircle, cropSquircle, cropRounded} {
+		img := patternImage(size)
+		newRasterCanvas(img).Crop(shape)
+		for y := 0; y < size; y++ {
+			for x := 0; x < size; x++ {
+				px := img.RGBAAt(x, y)
+				want := uint8(math.Round(cropCoverage(shape, size, x, y) * 255))
+				if px.A != want {
+					t.Fatalf("%s (%d, %d): alpha %d, want %d", shape, x, y, px.A, want)
+				}
+				if px.R > px.A || px.G > px.A || px.B > px.A {
+					t.Fatalf("%s (%d, %d): %v is not premultiplied", shape, x, y, px)
+				}
+			}
+		}
+	}
+
+	img := patternImage(size)
+	want := image.NewRGBA(img.Bounds())
+	copy(want.Pix, img.Pix)
+	newRasterCanvas(img).Crop(cropSquare)
+	for i := range img.Pix {
+		if img.Pix[i] != want.Pix[i] {
+			t.Fatal("square crop changed the image")
+		}
+	}
+}
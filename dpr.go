@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// devicePixelRatios are the display densities avatars are rendered for.
+var devicePixelRatios = []float64{1, 1.5, 2, 3}
+
+func parseDPR(raw string) (float64, error) {
+	dpr, err := strconv.ParseFloat(raw, 64)
+	if err != nil || !slices.Contains(devicePixelRatios, dpr) {
+		return 0, fmt.Errorf("invalid dpr %q, want %s", raw, dprList())
+	}
+	return dpr, nil
+}
+
+func formatDPR(dpr float64) string {
+	return strconv.FormatFloat(dpr, 'f', -1, 64)
+}
+
+func dprList() string {
+	names := make([]string, len(devicePixelRatios))
+	for i, dpr := range devicePixelRatios {
+		names[i] = formatDPR(dpr)
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " or " + names[len(names)-1]
+}
+
+// scaledCanvas draws an avatar laid out for a logical size onto a canvas
+// scale times larger, so features keep the proportions and pixel constants
+// tuned for the logical size instead of being picked for the physical one.
+type scaledCanvas struct {
+	*rasterCanvas
+	size  int
+	scale float64
+}
+
+func (s *scaledCanvas) Size() int {
+	return s.size
+}
+
+// point maps canvas space, where pixel centres sit on integers, from the
+// logical grid to the physical one.
+func (s *scaledCanvas) point(p vec) vec {
+	return vec{X: (p.X+0.5)*s.scale - 0.5, Y: (p.Y+0.5)*s.scale - 0.5}
+}
+
+func (s *scaledCanvas) points(points []vec) []vec {
+	scaled := make([]vec, len(points))
+	for i, p := range points {
+		scaled[i] = s.point(p)
+	}
+	return scaled
+}
+
+// rect maps rectangle bounds, which are pixel edges and so scale directly.
+func (s *scaledCanvas) rect(x0, y0, x1, y1 float64) (float64, float64, float64, float64) {
+	return x0 * s.scale, y0 * s.scale, x1 * s.scale, y1 * s.scale
+}
+
+func (s *scaledCanvas) FillRect(x0, y0, x1, y1 float64, fill color.RGBA) {
+	x0, y0, x1, y1 = s.rect(x0, y0, x1, y1)
+	s.rasterCanvas.FillRect(x0, y0, x1, y1, fill)
+}
+
+func (s *scaledCanvas) FillCircle(center vec, radius float64, fill color.RGBA) {
+	s.rasterCanvas.FillCircle(s.point(center), radius*s.scale, fill)
+}
+
+func (s *scaledCanvas) FillEllipse(center vec, rx, ry float64, fill color.RGBA) {
+	s.rasterCanvas.FillEllipse(s.point(center), rx*s.scale, ry*s.scale, fill)
+}
+
+func (s *scaledCanvas) FillPolygon(points []vec, fill color.RGBA) {
+	s.rasterCanvas.FillPolygon(s.points(points), fill)
+}
+
+func (s *scaledCanvas) StrokePolyline(points []vec, width float64, stroke color.RGBA) {
+	s.rasterCanvas.StrokePolyline(s.points(points), width*s.scale, stroke)
+}
+
+func (s *scaledCanvas) FillVerticalGradient(x0, y0, x1, y1 float64, top, bottom color.RGBA) {
+	x0, y0, x1, y1 = s.rect(x0, y0, x1, y1)
+	s.rasterCanvas.FillVerticalGradient(x0, y0, x1, y1, top, bottom)
+}
+
+func (s *scaledCanvas) PushClipRect(x0, y0, x1, y1 float64) {
+	x0, y0, x1, y1 = s.rect(x0, y0, x1, y1)
+	s.rasterCanvas.PushClipRect(x0, y0, x1, y1)
+}
+
+func (s *scaledCanvas) Vignette(center vec, radius float64) {
+	s.rasterCanvas.Vignette(s.point(center), radius*s.scale)
+}
+
+// Noise picks specks on the logical grid, so the grain keeps its size and
+// pattern whatever the dpr.
+func (s *scaledCanvas) Noise(rng randStream, intensity int) {
+	s.rasterCanvas.noise(rng, s.size, s.scale, intensity)
+}
+
+// srcsetResponse holds attributes ready to paste into an img element.
+type srcsetResponse struct {
+	Src    string `json:"src"`
+	Srcset string `json:"srcset"`
+	Sizes  string `json:"sizes"`
+}
+
+// srcsetHandler lists the /avatar URL for every display density the size
+// allows, taking the same parameters as /avatar. When signatures are required
+// the request itself must be signed, and each URL it returns is signed too.
+func srcsetHandler(w http.ResponseWriter, r *http.Request) {
+	p := queryParams(r)
+	p.route = srcsetRoute
+	req, err := parseAvatarRequest(p)
+	if err != nil {
+		http.Error(w, err.Error(), requestStatus(err))
+		return
+	}
+	labelRequest(r, req.size, "srcset")
+
+	q := r.URL.Query()
+	var resp srcsetResponse
+	var candidates []string
+	for _, dpr := range devicePixelRatios {
+		if (renderOptions{dpr: dpr}).pixels(req.size) > cfg.maxSize {
+			break
+		}
+		if dpr == 1 {
+			q.Del("dpr")
+		} else {
+			q.Set("dpr", formatDPR(dpr))
+		}
+		u := avatarURL(q)
+		if dpr == 1 {
+			resp.Src = u
+		}
+		candidates = append(candidates, u+" "+formatDPR(dpr)+"x")
+	}
+	resp.Srcset = strings.Join(candidates, ", ")
+	resp.Sizes = strconv.Itoa(req.size) + "px"
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// avatarURL is the relative /avatar URL for q, signed with the first key
+// when the deployment requires signatures.
+func avatarURL(q url.Values) string {
+	q.Del("sig")
+	if cfg.requireSignatures {
+		q.Set("sig", signParams(valuesParams(q), cfg.signingKeys[0]))
+	}
+	return (&url.URL{Path: "/avatar", RawQuery: q.Encode()}).String()
+}
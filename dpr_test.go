@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDPR(t *testing.T) {
+	for _, tc := range []struct {
+		raw  string
+		want float64
+		ok   bool
+	}{
+		{"1", 1, true},
+		{"1.5", 1.5, true},
+		{"2", 2, true},
+		{"2.0", 2, true},
+		{"3", 3, true},
+		{"1.25", 0, false},
+		{"4", 0, false},
+		{"0", 0, false},
+		{"-2", 0, false},
+		{"2x", 0, false},
+		{"NaN", 0, false},
+		{"", 0, false},
+	} {
+		got, err := parseDPR(tc.raw)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("parseDPR(%q) = %v, %v; want %v, ok %v", tc.raw, got, err, tc.want, tc.ok)
+		}
+	}
+}
+
+// TestScaledNoiseKeepsGrain checks that noise drawn at an integer dpr is the
+// 1x noise with every speck scaled up, not finer grain on the physical grid.
+func TestScaledNoiseKeepsGrain(t *testing.T) {
+	grey := color.RGBA{R: 128, G: 128, B: 128, A: 255}
+	noise := func(size int, scale int) *image.RGBA {
+		img := image.NewRGBA(image.Rect(0, 0, size*scale, size*scale))
+		var c canvas = newRasterCanvas(img)
+		if scale != 1 {
+			c = &scaledCanvas{rasterCanvas: c.(*rasterCanvas), size: size, scale: float64(scale)}
+		}
+		c.FillRect(0, 0, float64(size), float64(size), grey)
+		c.Noise(newHashStream(hashInput("noise", corpusTimeKey)).substream("noise"), size/(2*pixelUnit(size)))
+		return img
+	}
+	for _, size := range []int{32, 64, 100} {
+		want := noise(size, 1)
+		for _, scale := range []int{2, 3} {
+			got := noise(size, scale)
+			for y := 0; y < size*scale; y++ {
+				for x := 0; x < size*scale; x++ {
+					if got.RGBAAt(x, y) != want.RGBAAt(x/scale, y/scale) {
+						t.Fatalf("%dpx at %dx: pixel (%d, %d) is %v, 1x pixel is %v", size, scale, x, y, got.RGBAAt(x, y), want.RGBAAt(x/scale, y/scale))
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestSrcset(t *testing.T) {
+	saved := cfg
+	cfg.rateLimit = 0
+	cfg.maxSize = 256
+	t.Cleanup(func() { cfg = saved })
+	mux := newMux()
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/avatar/srcset?input=alice&size=100&shape=circle", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var resp srcsetResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	// 3x would be 300 pixels, over the maximum size.
+	want := "/avatar?input=alice&shape=circle&size=100 1x, " +
+		"/avatar?dpr=1.5&input=alice&shape=circle&size=100 1.5x, " +
+		"/avatar?dpr=2&input=alice&shape=circle&size=100 2x"
+	if resp.Srcset != want {
+		t.Errorf("srcset = %q, want %q", resp.Srcset, want)
+	}
+	if resp.Src != "/avatar?input=alice&shape=circle&size=100" || resp.Sizes != "100px" {
+		t.Errorf("src = %q, sizes = %q", resp.Src, resp.Sizes)
+	}
+	for _, candidate := range strings.Split(resp.Srcset, ", ") {
+		u, _, _ := strings.Cut(candidate, " ")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, u, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: status %d", u, rec.Code)
+		}
+	}
+}
+
+func TestSignedSrcsetURLs(t *testing.T) {
+	requireSignatures(t, "secret")
+	mux := newMux()
+	signed, err := signAvatarURL("/avatar/srcset?input=alice&size=64", []byte("secret"), 0, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, signed, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%s: status %d: %s", signed, rec.Code, rec.Body)
+	}
+	var resp srcsetResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	for _, candidate := range strings.Split(resp.Srcset, ", ") {
+		u, _, _ := strings.Cut(candidate, " ")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, u, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: status %d", u, rec.Code)
+		}
+	}
+}
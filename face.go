@@ -0,0 +1,176 @@
+package main
+
+import (
+	"image"
+	"math"
+)
+
+type headShape string
+
+const (
+	headRound       headShape = "round"
+	headOval        headShape = "oval"
+	headSquareJawed headShape = "square-jawed"
+	headLong        headShape = "long"
+	headHeart       headShape = "heart"
+)
+
+// faceTraits describe a shaped head. The head is an ellipse above its centre
+// line and a superellipse below it, all in units of the head radius.
+type faceTraits struct {
+	shape headShape
+	// width is the half width, and top and bottom the heights above and
+	// below the centre line; chinLength stretches the bottom further.
+	width, top, bottom float64
+	// jaw is the superellipse exponent of the lower half: 2 is elliptical
+	// and larger values square the jaw off.
+	jaw float64
+	// taper narrows the lower half towards the chin.
+	taper float64
+
+	chinLength float64
+	// eyeSpacing and mouthWidth are fractions of the head's half width at
+	// the eyes and at the mouth; eyeHeight is a fraction of top.
+	eyeSpacing float64
+	eyeHeight  float64
+	mouthWidth float64
+}
+
+var headShapes = []faceTraits{
+	{shape: headRound, width: 1, top: 1, bottom: 1, jaw: 2},
+	{shape: headOval, width: 0.86, top: 1, bottom: 1.06, jaw: 2, taper: 0.1},
+	{shape: headSquareJawed, width: 0.94, top: 1, bottom: 0.98, jaw: 4},
+	{shape: headLong, width: 0.8, top: 1.08, bottom: 1.08, jaw: 2.4, taper: 0.05},
+	{shape: headHeart, width: 0.98, top: 0.95, bottom: 1.06, jaw: 2, taper: 0.45},
+}
+
+// pickFace picks a head shape and proportions, and replaces the stepped head
+// radius with a continuous one small enough for the longest chin to fit.
+func pickFace(rng randStream, t *avatarTraits) *faceTraits {
+	f := headShapes[rng.nextInt(len(headShapes))]
+	f.chinLength = 0.1 * rng.nextFloat()
+	f.eyeSpacing = 0.4 + 0.16*rng.nextFloat()
+	f.eyeHeight = 0.1 + 0.2*rng.nextFloat()
+	f.mouthWidth = 0.3 + 0.2*rng.nextFloat()
+	t.headRadius = int(float64(t.size) * (0.3 + 0.08*rng.nextFloat()))
+	return &f
+}
+
+func (f *faceTraits) lower() float64 {
+	return f.bottom * (1 + f.chinLength)
+}
+
+// halfWidth is the half width of the head at dy below its centre, both in
+// units of the head radius.
+func (f *faceTraits) halfWidth(dy float64) float64 {
+	if dy < 0 {
+		s := math.Min(1, -dy/f.top)
+		return f.width * math.Sqrt(1-s*s)
+	}
+	s := math.Min(1, dy/f.lower())
+	sin := math.Pow(s, f.jaw/2)
+	cos := math.Sqrt(1 - sin*sin)
+	return f.width * math.Pow(cos, 2/f.jaw) * (1 - f.taper*s)
+}
+
+const headOutlinePoints = 72
+
+// outline returns the head as a polygon.
+func (f *faceTraits) outline(center image.Point, radius int) []vec {
+	r := float64(radius)
+	points := make([]vec, 0, headOutlinePoints)
+	for i := 0; i < headOutlinePoints; i++ {
+		sin, cos := math.Sincos(2 * math.Pi * float64(i) / headOutlinePoints)
+		var dy float64
+		if sin < 0 {
+			dy = f.top * sin
+		} else {
+			dy = f.lower() * math.Pow(sin, 2/f.jaw)
+		}
+		x := f.halfWidth(dy)
+		if cos < 0 {
+			x = -x
+		}
+		points = append(points, vec{X: float64(center.X) + x*r, Y: float64(center.Y) + dy*r})
+	}
+	return points
+}
+
+// faceLayout places the features that follow the head's shape.
+type faceLayout struct {
+	center image.Point
+	radius int
+	top    int
+	// The eyes sit eyeX either side of the centre line at eyeY.
+	eyeX, eyeY int
+	browY      int
+	noseY      int
+	// mouthY is the mouth's midline and mouthHalf half its width.
+	mouthY, mouthHalf        float64
+	lipY, lipWidth           int
+	mustacheY, mustacheWidth int
+	chinY                    int
+	// sideburnX is how far the sideburns' outer edges sit from the centre
+	// line and sideburnY is their top; the earrings and blush sit
+	// earringX and cheekX either side of it.
+	sideburnX, sideburnY int
+	earringX, earringY   int
+	cheekX, cheekY       int
+	maskY, maskWidth     int
+	scarY, scarLength    int
+	// markY is the forehead mark's centre, and shoulderY the first row
+	// below the chin, where the shoulders start.
+	markY     int
+	shoulderY int
+}
+
+// layout positions the features: at fixed fractions of the radius on a
+// round head, and along the head's outline on a shaped one.
+func (t *avatarTraits) layout() faceLayout {
+	c, r := t.center, t.headRadius
+	if t.face == nil {
+		return faceLayout{
+			center: c, radius: r, top: c.Y - r,
+			eyeX: r / 2, eyeY: c.Y - r/5, browY: c.Y - r/3,
+			noseY:  c.Y,
+			mouthY: float64(c.Y) + float64(r)/3.0, mouthHalf: float64(int(float64(r)*0.7) / 2),
+			lipY: c.Y + r/3, lipWidth: r / 3,
+			mustacheY: c.Y + r/6, mustacheWidth: r / 2,
+			chinY:     c.Y + r/2,
+			sideburnX: r - r/6, sideburnY: c.Y - r/4,
+			earringX: r * 5 / 6, earringY: c.Y + r/10,
+			cheekX: r / 2, cheekY: c.Y + r/6,
+			maskY: c.Y + r/4, maskWidth: int(float64(r) * 1.4),
+			scarY: c.Y - r/6, scarLength: r / 2,
+			markY: c.Y - r/2, shoulderY: c.Y + r,
+		}
+	}
+	f, rf := t.face, float64(r)
+	l := faceLayout{center: c, radius: r, top: c.Y - int(math.Round(f.top*rf))}
+	eyeDY := -f.eyeHeight * f.top
+	l.eyeY = c.Y + int(math.Round(eyeDY*rf))
+	l.eyeX = int(math.Round(f.eyeSpacing * f.halfWidth(eyeDY) * rf))
+	l.browY = l.eyeY - int(math.Round(0.13*rf))
+	mouthDY := 0.36 * f.lower()
+	l.mouthY = float64(c.Y) + math.Round(mouthDY*rf)
+	l.mouthHalf = math.Round(f.mouthWidth * f.halfWidth(mouthDY) * rf)
+	l.noseY = l.eyeY + int(math.Round(0.38*(l.mouthY-float64(l.eyeY))))
+	l.lipY, l.lipWidth = int(l.mouthY), int(l.mouthHalf*0.95)
+	l.mustacheY, l.mustacheWidth = int(l.mouthY)-r/6, int(l.mouthHalf*1.4)
+	l.chinY = c.Y + int(math.Round(f.lower()*rf)) - r/2
+	// dy converts a row to the units halfWidth takes.
+	dy := func(y int) float64 { return float64(y-c.Y) / rf }
+	l.sideburnY = l.eyeY
+	sideburnHalf := math.Min(f.halfWidth(dy(l.sideburnY)), f.halfWidth(dy(l.sideburnY+r/2)))
+	l.sideburnX = int(math.Round(sideburnHalf*rf)) - r/6
+	l.earringY = l.eyeY + int(math.Round(0.56*(l.mouthY-float64(l.eyeY))))
+	l.earringX = int(math.Round(f.halfWidth(dy(l.earringY)) * rf * 5 / 6))
+	l.cheekX, l.cheekY = l.eyeX, int(math.Round((float64(l.noseY)+l.mouthY)/2))
+	l.maskY = int(l.mouthY) - r/12
+	l.maskWidth = int(1.6 * f.halfWidth(dy(l.maskY+r/4)) * rf)
+	l.scarY = l.eyeY + (l.noseY-l.eyeY)/4
+	l.scarLength = int(math.Round(0.5 * f.halfWidth(dy(l.scarY)) * rf))
+	l.markY = (l.top + l.browY) / 2
+	l.shoulderY = c.Y + int(math.Ceil(f.lower()*rf))
+	return l
+}
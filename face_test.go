@@ -0,0 +1,106 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestLegacyLayout(t *testing.T) {
+	tr := &avatarTraits{center: image.Point{X: 64, Y: 64}, headRadius: 49}
+	got := tr.layout()
+	want := faceLayout{
+		center: tr.center, radius: 49, top: 15,
+		eyeX: 24, eyeY: 55, browY: 48,
+		noseY: 64, mouthY: 64 + 49/3.0, mouthHalf: 17,
+		lipY: 80, lipWidth: 16,
+		mustacheY: 72, mustacheWidth: 24,
+		chinY:     88,
+		sideburnX: 41, sideburnY: 52,
+		earringX: 40, earringY: 68,
+		cheekX: 24, cheekY: 72,
+		maskY: 76, maskWidth: 68,
+		scarY: 56, scarLength: 24,
+		markY: 40, shoulderY: 113,
+	}
+	if got != want {
+		t.Errorf("layout = %+v\nwant %+v", got, want)
+	}
+}
+
+// TestShapedLayoutFollowsOutline checks the features placed from the head's
+// half width stay on the face for every shape.
+func TestShapedLayoutFollowsOutline(t *testing.T) {
+	const size = 256
+	for _, shape := range headShapes {
+		for _, proportion := range []float64{0, 0.5, 1} {
+			f := shape
+			f.chinLength = 0.1 * proportion
+			f.eyeSpacing = 0.4 + 0.16*proportion
+			f.eyeHeight = 0.1 + 0.2*proportion
+			f.mouthWidth = 0.3 + 0.2*proportion
+			tr := &avatarTraits{size: size, center: image.Point{X: size / 2, Y: size / 2}, headRadius: 90, face: &f}
+			l := tr.layout()
+			r := float64(l.radius)
+			edge := func(y int) float64 { return f.halfWidth(float64(y-l.center.Y)/r) * r }
+
+			for _, y := range []int{l.sideburnY, l.sideburnY + l.radius/2 - 1} {
+				if float64(l.sideburnX) > edge(y) {
+					t.Errorf("%s %.1f: sideburn at row %d reaches %d, head edge is %.1f", f.shape, proportion, y, l.sideburnX, edge(y))
+				}
+			}
+			if e := edge(l.earringY); float64(l.earringX) > e || float64(l.earringX) < 0.75*e {
+				t.Errorf("%s %.1f: earring at %d, head edge is %.1f", f.shape, proportion, l.earringX, e)
+			}
+			if l.cheekY <= l.noseY || float64(l.cheekY) >= l.mouthY {
+				t.Errorf("%s %.1f: cheek at row %d, not between nose %d and mouth %.0f", f.shape, proportion, l.cheekY, l.noseY, l.mouthY)
+			}
+			if float64(l.cheekX+l.radius/6) > edge(l.cheekY) {
+				t.Errorf("%s %.1f: blush reaches %d, head edge is %.1f", f.shape, proportion, l.cheekX+l.radius/6, edge(l.cheekY))
+			}
+			if mid := l.maskY + l.radius/4; float64(l.maskWidth)/2 > edge(mid) {
+				t.Errorf("%s %.1f: mask half width %d, head edge is %.1f", f.shape, proportion, l.maskWidth/2, edge(mid))
+			}
+			if float64(l.scarLength)/2 > edge(l.scarY) {
+				t.Errorf("%s %.1f: scar half length %d, head edge is %.1f", f.shape, proportion, l.scarLength/2, edge(l.scarY))
+			}
+		}
+	}
+}
+
+// TestShouldersLeaveTheChin draws the shoulders over every head shape, chin
+// at its shortest and longest, and checks they cover none of the head.
+func TestShouldersLeaveTheChin(t *testing.T) {
+	const size = 128
+	head, _ := findLayer("head")
+	shoulders, _ := findLayer("shoulders")
+	colors := avatarColors{
+		skin:     color.RGBA{R: 241, G: 194, B: 125, A: 255},
+		clothing: color.RGBA{R: 52, G: 86, B: 136, A: 255},
+		accent:   color.RGBA{R: 255, G: 210, B: 90, A: 255},
+	}
+	for _, shape := range headShapes {
+		for _, chinLength := range []float64{0, 0.1} {
+			f := shape
+			f.chinLength = chinLength
+			tr := &avatarTraits{size: size, center: image.Point{X: size / 2, Y: size / 2}, headRadius: size * 38 / 100, face: &f, colors: colors}
+			img := image.NewRGBA(image.Rect(0, 0, size, size))
+			c := newRasterCanvas(img)
+			head.Draw(c, tr)
+			before := image.NewRGBA(img.Rect)
+			copy(before.Pix, img.Pix)
+			shoulders.Draw(c, tr)
+			covered := 0
+			for y := 0; y < size; y++ {
+				for x := 0; x < size; x++ {
+					if before.RGBAAt(x, y) == colors.skin && img.RGBAAt(x, y) != colors.skin {
+						covered++
+					}
+				}
+			}
+			if covered > 0 {
+				t.Errorf("%s, chin %.1f: shoulders cover %d pixels of the head", f.shape, chinLength, covered)
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type avatarFormat string
+
+const (
+	formatPNG avatarFormat = "png"
+	formatSVG avatarFormat = "svg"
+)
+
+var formatMediaTypes = map[avatarFormat]string{
+	formatPNG: "image/png",
+	formatSVG: "image/svg+xml",
+}
+
+// formatPreference lists the encoders in the order that breaks ties in
+// Accept negotiation.
+var formatPreference = []avatarFormat{formatPNG, formatSVG}
+
+var errNotAcceptable = errors.New("no available representation is acceptable")
+
+// resolveFormat honours an explicit format parameter and otherwise lets the
+// Accept header pick the encoder with the highest quality. Ties go to PNG, so
+// browser <img> requests that merely allow image/* keep receiving PNG.
+func resolveFormat(param string, accept string) (avatarFormat, error) {
+	if param != "" {
+		format := avatarFormat(strings.ToLower(param))
+		if _, ok := formatMediaTypes[format]; !ok {
+			return "", fmt.Errorf("unsupported format %q", param)
+		}
+		return format, nil
+	}
+	format, ok := negotiate(parseAccept(accept), formatPreference, func(f avatarFormat) string {
+		return formatMediaTypes[f]
+	})
+	if !ok {
+		return "", fmt.Errorf("%w: this endpoint serves image/png and image/svg+xml", errNotAcceptable)
+	}
+	return format, nil
+}
+
+// negotiate returns the first of offers with the highest non-zero quality.
+func negotiate[T any](ranges []acceptRange, offers []T, mediaType func(T) string) (T, bool) {
+	var best T
+	bestQuality := 0.0
+	for _, offer := range offers {
+		if q := acceptQuality(ranges, mediaType(offer)); q > bestQuality {
+			best, bestQuality = offer, q
+		}
+	}
+	return best, bestQuality > 0
+}
+
+type acceptRange struct {
+	mediaType string
+	quality   float64
+}
+
+func parseAccept(header string) []acceptRange {
+	var ranges []acceptRange
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(fields[0]))
+		if mediaType == "" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range fields[1:] {
+			key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if !ok || strings.ToLower(strings.TrimSpace(key)) != "q" {
+				continue
+			}
+			if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				quality = parsed
+			}
+		}
+		ranges = append(ranges, acceptRange{mediaType: mediaType, quality: quality})
+	}
+	return ranges
+}
+
+// acceptQuality returns the quality of the most specific range matching
+// mediaType. An empty Accept header accepts everything.
+func acceptQuality(ranges []acceptRange, mediaType string) float64 {
+	if len(ranges) == 0 {
+		return 1
+	}
+	major, _, _ := strings.Cut(mediaType, "/")
+	best, specificity := 0.0, -1
+	for _, r := range ranges {
+		rank := -1
+		switch r.mediaType {
+		case mediaType:
+			rank = 2
+		case major + "/*":
+			rank = 1
+		case "*/*":
+			rank = 0
+		}
+		if rank > specificity {
+			best, specificity = r.quality, rank
+		}
+	}
+	return best
+}
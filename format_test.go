@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolveFormat(t *testing.T) {
+	for _, tc := range []struct {
+		param  string
+		accept string
+		want   avatarFormat
+		err    error
+	}{
+		{"", "", formatPNG, nil},
+		{"", "*/*", formatPNG, nil},
+		{"", "image/*", formatPNG, nil},
+		{"", "image/svg+xml", formatSVG, nil},
+		{"", "image/png;q=0.5, image/svg+xml", formatSVG, nil},
+		{"", "image/svg+xml;q=0.8, image/*;q=0.9", formatPNG, nil},
+		{"", "image/*, image/png;q=0", formatSVG, nil},
+		{"", "IMAGE/SVG+XML", formatSVG, nil},
+		{"", "text/html, application/xhtml+xml, image/webp, */*;q=0.8", formatPNG, nil},
+		{"", "application/json", "", errNotAcceptable},
+		{"", "image/*;q=0", "", errNotAcceptable},
+		{"svg", "image/png", formatSVG, nil},
+		{"PNG", "application/json", formatPNG, nil},
+		{"gif", "", "", errors.New("unsupported format")},
+	} {
+		got, err := resolveFormat(tc.param, tc.accept)
+		switch {
+		case tc.err == nil && err != nil:
+			t.Errorf("format=%q Accept %q: %v", tc.param, tc.accept, err)
+		case tc.err != nil && err == nil:
+			t.Errorf("format=%q Accept %q: got %s, want an error", tc.param, tc.accept, got)
+		case errors.Is(tc.err, errNotAcceptable) && !errors.Is(err, errNotAcceptable):
+			t.Errorf("format=%q Accept %q: %v, want errNotAcceptable", tc.param, tc.accept, err)
+		case got != tc.want:
+			t.Errorf("format=%q Accept %q: got %s, want %s", tc.param, tc.accept, got, tc.want)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	offers := []string{"application/json", "text/plain"}
+	for _, tc := range []struct {
+		accept string
+		want   string
+		ok     bool
+	}{
+		{"", "application/json", true},
+		{"text/plain", "text/plain", true},
+		{"text/*;q=0.9, application/json;q=0.5", "text/plain", true},
+		{"application/json;q=0.5, text/plain;q=0.5", "application/json", true},
+		{"*/*;q=0.1, application/json;q=0", "text/plain", true},
+		{"image/png", "", false},
+	} {
+		got, ok := negotiate(parseAccept(tc.accept), offers, func(s string) string { return s })
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("Accept %q: got %q, %v, want %q, %v", tc.accept, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestAcceptOnlyNegotiatesImages(t *testing.T) {
+	saved := cfg
+	cfg.rateLimit = 0
+	t.Cleanup(func() { cfg = saved })
+	mux := newMux()
+
+	for _, tc := range []struct {
+		url    string
+		accept string
+		want   int
+		ctype  string
+	}{
+		{"/avatar/traits?input=alice", "application/json", http.StatusOK, "application/json"},
+		{"/avatar/srcset?input=alice", "application/json", http.StatusOK, "application/json"},
+		{"/avatar/traits?input=alice&format=svg", "application/json", http.StatusOK, "application/json"},
+		{"/avatar?input=alice", "application/json", http.StatusNotAcceptable, ""},
+		{"/avatar/alice", "application/json", http.StatusNotAcceptable, ""},
+		{"/avatar?input=alice", "image/svg+xml", http.StatusOK, "image/svg+xml"},
+		{"/avatar/alice", "image/*", http.StatusOK, "image/png"},
+		{"/avatar/alice/64.svg", "application/json", http.StatusOK, "image/svg+xml"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+		req.Header.Set("Accept", tc.accept)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s with Accept %q: status %d, want %d", tc.url, tc.accept, rec.Code, tc.want)
+			continue
+		}
+		if got := rec.Header().Get("Content-Type"); tc.ctype != "" && got != tc.ctype {
+			t.Errorf("%s with Accept %q: Content-Type %q, want %q", tc.url, tc.accept, got, tc.ctype)
+		}
+	}
+}
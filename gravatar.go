@@ -0,0 +1,121 @@
+package main
+
+import (
+	"image"
+	"image/png"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gravatarPath matches the /avatar/{hash}[.ext] segment of Gravatar URLs,
+// which carry the MD5 or SHA-256 hex digest of the normalised email address.
+var gravatarPath = regexp.MustCompile(`^([0-9a-fA-F]{32}|[0-9a-fA-F]{64})(?:\.([A-Za-z]+))?$`)
+
+const (
+	gravatarDefaultSize = 80
+	// gravatarMysteryInput seeds the fixed avatar served for d=mp.
+	gravatarMysteryInput = "gravatar:mystery-person"
+)
+
+// gravatarHandler maps Gravatar's query parameters onto the avatar renderer
+// so tools that only know how to build Gravatar URLs can point at this
+// service. Every hash has a generated avatar, so d= only matters together
+// with f=y, and every avatar is suitable for any r= rating.
+func gravatarHandler(w http.ResponseWriter, r *http.Request, hash string, ext string) {
+	params := gravatarParams(r.URL.Query(), hash, ext)
+	if err := verifySignature(params, time.Now()); err != nil {
+		http.Error(w, err.Error(), requestStatus(err))
+		return
+	}
+
+	if strings.HasPrefix(strings.ToLower(params.force), "y") {
+		switch strings.ToLower(params.fallback) {
+		case "404":
+			http.NotFound(w, r)
+			return
+		case "blank":
+			serveBlankAvatar(w, r, params)
+			return
+		case "mp", "mm", "mystery":
+			params.input = gravatarMysteryInput
+			params.rotation = string(rotateNever)
+			params.timestamp = ""
+		case "", "identicon", "monsterid", "wavatar", "retro", "robohash", "initials", "color":
+		default:
+			if target, err := url.Parse(params.fallback); err == nil && (target.Scheme == "http" || target.Scheme == "https") {
+				http.Redirect(w, r, target.String(), http.StatusFound)
+				return
+			}
+		}
+	}
+
+	req, err := parseAvatarParams(params)
+	if err != nil {
+		http.Error(w, err.Error(), requestStatus(err))
+		return
+	}
+	serveAvatar(w, r, req)
+}
+
+// gravatarParams maps a Gravatar URL onto avatar parameters. The result,
+// not the raw query, is what a signature covers. It includes d= and f=, so a
+// signed URL cannot be turned into a redirect elsewhere; r= stays unsigned
+// because every avatar suits every rating.
+func gravatarParams(q url.Values, hash string, ext string) avatarParams {
+	params := valuesParams(q)
+	params.input = strings.ToLower(hash)
+	params.size = strconv.Itoa(gravatarSize(firstParam(q, "s", "size")))
+	params.fallback = firstParam(q, "d", "default")
+	params.force = firstParam(q, "f", "forcedefault")
+	params.format = ""
+	if strings.EqualFold(ext, string(formatSVG)) {
+		params.format = string(formatSVG)
+	}
+	return params
+}
+
+// gravatarSize follows Gravatar in falling back to the default for missing
+// or malformed sizes and clamping everything else to the supported range.
+func gravatarSize(raw string) int {
+	size, err := strconv.Atoi(raw)
+	if err != nil || size <= 0 {
+		size = gravatarDefaultSize
+	}
+	return min(max(size, cfg.minSize), cfg.maxSize)
+}
+
+func firstParam(q url.Values, names ...string) string {
+	for _, name := range names {
+		if v := q.Get(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func serveBlankAvatar(w http.ResponseWriter, r *http.Request, params avatarParams) {
+	params.input = "blank"
+	params.format = string(formatPNG)
+	req, err := parseAvatarParams(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	labelRequest(r, req.size, string(formatPNG))
+	pixels := req.render.pixels(req.size)
+	etag := avatarETag(nil, pixels, "blank", renderOptions{})
+	w.Header().Set("Content-Type", formatMediaTypes[formatPNG])
+	setCacheHeaders(w.Header(), etag, req.window, time.Now())
+	if notModified(r, etag, req.window.start) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	png.Encode(w, image.NewRGBA(image.Rect(0, 0, pixels, pixels)))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readiness is what /readyz reports: not ready until the first self-test
+// passes, after any failed self-test, and once shutdown has begun.
+var readiness struct {
+	sync.Mutex
+	selfTest error
+	draining bool
+}
+
+func init() {
+	readiness.selfTest = errors.New("self-test has not run yet")
+}
+
+// selfTest renders every published version's smoke render, so a build that
+// would silently change existing avatars never reports ready. The full corpus
+// is left to the verify subcommand.
+func selfTest() error {
+	return verifySmoke()
+}
+
+func runSelfTest() {
+	err := selfTest()
+	if err != nil {
+		slog.Error("self-test failed, reporting not ready", "err", err)
+	}
+	readiness.Lock()
+	readiness.selfTest = err
+	readiness.Unlock()
+}
+
+// selfTestLoop repeats the self-test every interval until ctx is cancelled.
+func selfTestLoop(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			runSelfTest()
+		}
+	}
+}
+
+// markDraining makes /readyz fail so load balancers stop sending traffic
+// while requests in flight finish.
+func markDraining() {
+	readiness.Lock()
+	readiness.draining = true
+	readiness.Unlock()
+}
+
+// healthzHandler reports liveness: the process is up and serving HTTP.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte("ok\n"))
+}
+
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	readiness.Lock()
+	err, draining := readiness.selfTest, readiness.draining
+	readiness.Unlock()
+
+	w.Header().Set("Cache-Control", "no-store")
+	switch {
+	case draining:
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		w.Write([]byte("ok\n"))
+	}
+}
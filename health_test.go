@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSelfTestIsCheap(t *testing.T) {
+	start := time.Now()
+	if err := selfTest(); err != nil {
+		t.Fatal(err)
+	}
+	// The full corpus takes seconds; the smoke renders must not creep
+	// towards it, since /readyz repeats them while serving.
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("self-test took %v", elapsed)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	saved := readiness.selfTest
+	t.Cleanup(func() {
+		readiness.Lock()
+		readiness.selfTest, readiness.draining = saved, false
+		readiness.Unlock()
+	})
+
+	for _, tc := range []struct {
+		name     string
+		selfTest error
+		draining bool
+		want     int
+	}{
+		{"not run yet", errors.New("self-test has not run yet"), false, http.StatusServiceUnavailable},
+		{"passed", nil, false, http.StatusOK},
+		{"failed", errors.New("version 1 renders smoke digest 00"), false, http.StatusServiceUnavailable},
+		{"draining", nil, true, http.StatusServiceUnavailable},
+	} {
+		readiness.Lock()
+		readiness.selfTest, readiness.draining = tc.selfTest, tc.draining
+		readiness.Unlock()
+
+		w := httptest.NewRecorder()
+		readyzHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+		if w.Code != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.name, w.Code, tc.want)
+		}
+	}
+}
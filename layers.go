@@ -0,0 +1,491 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Layer is one feature of an avatar. Pick draws whatever the layer needs
+// from the hash-seeded stream into the traits, and Draw paints the layer
+// from the traits alone. Z orders drawing; it does not affect picking.
+// Blend is the mode the layer's shapes are composited with, and Clip the
+// mask they are clipped to.
+type Layer interface {
+	Name() string
+	Z() int
+	Blend() blendMode
+	Clip() layerClip
+	Pick(rng randStream, t *avatarTraits)
+	Draw(c canvas, t *avatarTraits)
+}
+
+type layerFuncs struct {
+	name  string
+	z     int
+	blend blendMode
+	clip  layerClip
+	pick  func(rng randStream, t *avatarTraits)
+	draw  func(c canvas, t *avatarTraits)
+}
+
+func (l layerFuncs) Name() string { return l.name }
+func (l layerFuncs) Z() int       { return l.z }
+
+func (l layerFuncs) Blend() blendMode {
+	if l.blend == "" {
+		return blendNormal
+	}
+	return l.blend
+}
+
+func (l layerFuncs) Clip() layerClip { return l.clip }
+
+func (l layerFuncs) Pick(rng randStream, t *avatarTraits) {
+	if l.pick != nil {
+		l.pick(rng, t)
+	}
+}
+
+func (l layerFuncs) Draw(c canvas, t *avatarTraits) {
+	l.draw(c, t)
+}
+
+// layerRegistry lists every layer in pick order. Every layer picks whether
+// or not it is drawn, so disabling or reordering layers never shifts the
+// stream under the others. Versions on the legacy byte stream share one
+// position between all layers, so new layers must be appended and must not
+// pick there; versions with substreams give each layer its own stream.
+var layerRegistry = []Layer{
+	layerFuncs{name: "background", z: 0, draw: func(c canvas, t *avatarTraits) {
+		c.FillRect(0, 0, float64(t.size), float64(t.size), t.colors.background)
+	}},
+	layerFuncs{name: "head", z: 10, draw: func(c canvas, t *avatarTraits) {
+		if t.face != nil {
+			c.FillPolygon(t.face.outline(t.center, t.headRadius), t.colors.skin)
+			return
+		}
+		drawFilledCircle(c, t.center, t.headRadius, t.colors.skin)
+	}},
+	layerFuncs{name: "cheek-shade", z: 20, draw: func(c canvas, t *avatarTraits) {
+		drawFilledCircle(c, image.Point{X: t.center.X - t.headRadius/3, Y: t.center.Y + t.headRadius/5}, t.headRadius/6, blendColor(t.colors.skin, 0.2))
+	}},
+	layerFuncs{name: "background-gradient", z: 30, draw: func(c canvas, t *avatarTraits) {
+		drawBackgroundGradient(c, t.colors.background, t.colors.accent)
+	}},
+	layerFuncs{name: "hair", z: 40, pick: func(rng randStream, t *avatarTraits) {
+		t.hairHeight = int(float64(t.headRadius) * (0.55 + 0.1*float64(rng.nextInt(3))))
+	}, draw: func(c canvas, t *avatarTraits) {
+		drawHair(c, t.center, t.headRadius, t.layout().top, t.hairHeight, t.colors.hair)
+	}},
+	layerFuncs{name: "hair-strands", z: 50, pick: func(rng randStream, t *avatarTraits) {
+		t.strands = pickHairStrands(rng, t.center, t.headRadius)
+	}, draw: func(c canvas, t *avatarTraits) {
+		drawHairStrands(c, t.strands, blendColor(t.colors.hair, 0.2))
+	}},
+	layerFuncs{name: "sideburns", z: 60, pick: func(rng randStream, t *avatarTraits) {
+		t.sideburns = rng.nextInt(2) != 0
+	}, draw: func(c canvas, t *avatarTraits) {
+		if t.sideburns {
+			drawSideburns(c, t.layout(), t.colors.hair)
+		}
+	}},
+	layerFuncs{name: "neck", z: 70, draw: func(c canvas, t *avatarTraits) {
+		drawNeck(c, t.center, t.headRadius, t.colors.neck)
+	}},
+	layerFuncs{name: "cape", z: 80, pick: func(rng randStream, t *avatarTraits) {
+		t.cape = rng.nextInt(3) == 0
+	}, draw: func(c canvas, t *avatarTraits) {
+		if t.cape {
+			drawCape(c, t.center, t.headRadius, t.colors.cape)
+		}
+	}},
+	layerFuncs{name: "shoulders", z: 90, pick: func(rng randStream, t *avatarTraits) {
+		t.shoulders = shoulderChevron
+		if rng.nextInt(2) != 0 {
+			t.shoulders = shoulderStripe
+		}
+	}, draw: func(c canvas, t *avatarTraits) {
+		drawShoulders(c, t.layout(), t.colors.clothing, t.colors.accent, t.shoulders)
+	}},
+	layerFuncs{name: "background-accents", z: 100, pick: func(rng randStream, t *avatarTraits) {
+		t.background = pickBackgroundAccent(rng, t.center, t.headRadius, t.size)
+	}, draw: func(c canvas, t *avatarTraits) {
+		drawBackgroundAccents(c, t.center, t.headRadius, t.colors.accent, t.background)
+	}},
+	layerFuncs{name: "frame", z: 110, draw: func(c canvas, t *avatarTraits) {
+		drawFrameBorder(c, t.colors.frame)
+	}},
+	layerFuncs{name: "accessories", z: 120, pick: func(rng randStream, t *avatarTraits) {
+		t.accessory = pickAccessory(rng, t.center, t.headRadius)
+	}, draw: func(c canvas, t *avatarTraits) {
+		drawAccessories(c, t.layout(), t.colors.accessory, t.colors.skin, t.accessory)
+	}},
+	layerFuncs{name: "mask", z: 130, pick: func(rng randStream, t *avatarTraits) {
+		t.mask = rng.nextInt(4) == 0
+	}, draw: func(c canvas, t *avatarTraits) {
+		if t.mask {
+			drawMask(c, t.layout(), t.colors.mask)
+		}
+	}},
+	layerFuncs{name: "eyes", z: 140, pick: func(rng randStream, t *avatarTraits) {
+		t.eyeShift = rng.nextInt(3) - 1
+	}, draw: func(c canvas, t *avatarTraits) {
+		drawEyes(c, t.layout(), t.colors.eye, t.eyeShift)
+	}},
+	layerFuncs{name: "iris-highlights", z: 150, pick: func(rng randStream, t *avatarTraits) {
+		t.irisShift = rng.nextInt(2)
+	}, draw: func(c canvas, t *avatarTraits) {
+		drawIrisHighlights(c, t.layout(), t.colors.irisHighlight, t.irisShift)
+	}},
+	layerFuncs{name: "eyebrows", z: 160, pick: func(rng randStream, t *avatarTraits) {
+		t.browTilt = rng.nextInt(5) - 2
+	}, draw: func(c canvas, t *avatarTraits) {
+		drawEyebrows(c, t.layout(), t.colors.brow, t.browTilt)
+	}},
+	layerFuncs{name: "nose", z: 170, draw: func(c canvas, t *avatarTraits) {
+		drawNose(c, t.layout())
+	}},
+	layerFuncs{name: "blush", z: 180, pick: func(rng randStream, t *avatarTraits) {
+		t.blush = rng.nextInt(3) != 0
+	}, draw: func(c canvas, t *avatarTraits) {
+		if t.blush {
+			drawBlush(c, t.layout(), t.colors.blush)
+		}
+	}},
+	layerFuncs{name: "scar", z: 190, pick: func(rng randStream, t *avatarTraits) {
+		if rng.nextInt(4) == 0 {
+			t.scar = true
+			t.scarSlope = float64(rng.nextInt(5)-2) * 0.2
+		}
+	}, draw: func(c canvas, t *avatarTraits) {
+		if t.scar {
+			drawScar(c, t.layout(), t.colors.scar, t.scarSlope)
+		}
+	}},
+	layerFuncs{name: "mouth", z: 200, pick: func(rng randStream, t *avatarTraits) {
+		t.mouthCurve = float64(rng.nextInt(6)-2) / 10.0
+	}, draw: func(c canvas, t *avatarTraits) {
+		drawMouth(c, t.layout(), t.colors.mouth, t.mouthCurve)
+	}},
+	layerFuncs{name: "lip-shine", z: 210, pick: func(rng randStream, t *avatarTraits) {
+		t.lipShine = rng.nextInt(2) != 0
+	}, draw: func(c canvas, t *avatarTraits) {
+		if t.lipShine {
+			drawLipShine(c, t.layout(), t.colors.lip)
+		}
+	}},
+	layerFuncs{name: "mustache", z: 220, pick: func(rng randStream, t *avatarTraits) {
+		t.mustache = rng.nextInt(3) == 0
+	}, draw: func(c canvas, t *avatarTraits) {
+		if t.mustache {
+			drawMustache(c, t.layout(), t.colors.hair)
+		}
+	}},
+	layerFuncs{name: "chin-shadow", z: 230, pick: func(rng randStream, t *avatarTraits) {
+		t.chinShadow = rng.nextInt(2) == 0
+	}, draw: func(c canvas, t *avatarTraits) {
+		if t.chinShadow {
+			drawChinShadow(c, t.layout(), t.colors.shadow)
+		}
+	}},
+	layerFuncs{name: "forehead-mark", z: 240, pick: func(rng randStream, t *avatarTraits) {
+		t.foreheadMark = rng.nextInt(4) == 0
+	}, draw: func(c canvas, t *avatarTraits) {
+		if t.foreheadMark {
+			drawForeheadMark(c, t.layout(), t.colors.mark)
+		}
+	}},
+	layerFuncs{name: "hood", z: 250, pick: func(rng randStream, t *avatarTraits) {
+		t.hood = rng.nextInt(3) == 0
+	}, draw: func(c canvas, t *avatarTraits) {
+		if t.hood {
+			drawHood(c, t.layout(), t.colors.hood)
+		}
+	}},
+	layerFuncs{name: "vignette", z: 260, draw: func(c canvas, t *avatarTraits) {
+		c.Vignette(pt(t.center.X, t.center.Y), float64(int(float64(t.size)*0.48)))
+	}},
+	layerFuncs{name: "noise", z: 270, pick: func(rng randStream, t *avatarTraits) {
+		t.noise = rng.detach()
+	}, draw: func(c canvas, t *avatarTraits) {
+		c.Noise(t.noise.detach(), t.size/(2*pixelUnit(t.size)))
+	}},
+	// The beard is picked with the other accessories but drawn by its own
+	// layer, straight after them, so it can be clipped to the head without
+	// clipping the hat.
+	layerFuncs{name: "beard", z: 120, draw: func(c canvas, t *avatarTraits) {
+		if t.accessory.kind == accessoryBeard {
+			face := t.layout()
+			drawBeard(c, face.center, face.radius, t.colors.accessory, t.accessory.height)
+		}
+	}},
+}
+
+// backgroundLayers are left out of avatars with a transparent background.
+var backgroundLayers = []string{"background", "background-gradient", "background-accents", "frame", "vignette"}
+
+func findLayer(name string) (Layer, bool) {
+	for _, l := range layerRegistry {
+		if l.Name() == name {
+			return l, true
+		}
+	}
+	return nil, false
+}
+
+// layerClip clips a layer to the area an earlier layer covered, or to
+// everything outside it when invert is set. The zero value does not clip.
+type layerClip struct {
+	mask   string
+	invert bool
+}
+
+func (lc layerClip) String() string {
+	if lc.invert {
+		return "!" + lc.mask
+	}
+	return lc.mask
+}
+
+// layerConfig customises the pipeline: which layers are left out and which
+// get a different z-order, blend mode or clip.
+type layerConfig struct {
+	disabled []string
+	z        map[string]int
+	blend    map[string]blendMode
+	clip     map[string]layerClip
+}
+
+func (lc layerConfig) names() []string {
+	names := slices.Clone(lc.disabled)
+	for name := range lc.z {
+		names = append(names, name)
+	}
+	for name := range lc.blend {
+		names = append(names, name)
+	}
+	for name, clip := range lc.clip {
+		names = append(names, name, clip.mask)
+	}
+	return names
+}
+
+// merge applies over on top of lc.
+func (lc layerConfig) merge(over layerConfig) layerConfig {
+	merged := layerConfig{
+		disabled: append(slices.Clone(lc.disabled), over.disabled...),
+		z:        map[string]int{},
+		blend:    map[string]blendMode{},
+		clip:     map[string]layerClip{},
+	}
+	for _, m := range []layerConfig{lc, over} {
+		for name, z := range m.z {
+			merged.z[name] = z
+		}
+		for name, mode := range m.blend {
+			merged.blend[name] = mode
+		}
+		for name, clip := range m.clip {
+			merged.clip[name] = clip
+		}
+	}
+	return merged
+}
+
+// signature describes the customisation, or is empty when there is none.
+func (lc layerConfig) signature() string {
+	var parts []string
+	for _, name := range lc.disabled {
+		parts = append(parts, "-"+name)
+	}
+	for name, z := range lc.z {
+		parts = append(parts, name+"@"+strconv.Itoa(z))
+	}
+	for name, mode := range lc.blend {
+		parts = append(parts, name+"~"+string(mode))
+	}
+	for name, clip := range lc.clip {
+		parts = append(parts, name+"/"+clip.String())
+	}
+	slices.Sort(parts)
+	return strings.Join(slices.Compact(parts), ",")
+}
+
+// pipeline is the ordered list of layers that get drawn.
+type pipeline struct {
+	layers []Layer
+	// masks names the layers whose coverage later layers are clipped to.
+	masks map[string]bool
+	// streams selects the ChaCha8 stream with per-layer substreams over the
+	// legacy byte stream.
+	streams bool
+	// shapedHeads picks a head shape and face proportions.
+	shapedHeads bool
+	// overwrite draws normal layers in replace mode.
+	overwrite bool
+}
+
+type configuredLayer struct {
+	Layer
+	z     int
+	blend blendMode
+	clip  layerClip
+}
+
+func (l configuredLayer) Z() int           { return l.z }
+func (l configuredLayer) Blend() blendMode { return l.blend }
+func (l configuredLayer) Clip() layerClip  { return l.clip }
+
+// newPipeline builds the drawing order from the registry, leaving out
+// disabled layers and applying z-order, blend mode and clip overrides. A
+// layer can only be clipped to a layer drawn before it.
+func newPipeline(lc layerConfig) (*pipeline, error) {
+	for _, name := range lc.names() {
+		if _, ok := findLayer(name); !ok {
+			return nil, fmt.Errorf("unknown layer %q", name)
+		}
+	}
+
+	p := &pipeline{}
+	for _, l := range layerRegistry {
+		if slices.Contains(lc.disabled, l.Name()) {
+			continue
+		}
+		z, zSet := lc.z[l.Name()]
+		blend, blendSet := lc.blend[l.Name()]
+		clip, clipSet := lc.clip[l.Name()]
+		if zSet || blendSet || clipSet {
+			configured := configuredLayer{Layer: l, z: l.Z(), blend: l.Blend(), clip: l.Clip()}
+			if zSet {
+				configured.z = z
+			}
+			if blendSet {
+				configured.blend = blend
+			}
+			if clipSet {
+				configured.clip = clip
+			}
+			l = configured
+		}
+		p.layers = append(p.layers, l)
+	}
+	slices.SortStableFunc(p.layers, func(a, b Layer) int {
+		return a.Z() - b.Z()
+	})
+
+	p.masks = map[string]bool{}
+	for i, l := range p.layers {
+		mask := l.Clip().mask
+		if mask == "" {
+			continue
+		}
+		if !slices.ContainsFunc(p.layers[:i], func(earlier Layer) bool { return earlier.Name() == mask }) {
+			return nil, fmt.Errorf("layer %q is clipped to %q, which is not drawn before it", l.Name(), mask)
+		}
+		p.masks[mask] = true
+	}
+	return p, nil
+}
+
+// without returns a copy of the pipeline that leaves out the named layers.
+func (p *pipeline) without(names []string) *pipeline {
+	q := *p
+	q.layers = slices.DeleteFunc(slices.Clone(p.layers), func(l Layer) bool {
+		return slices.Contains(names, l.Name())
+	})
+	return &q
+}
+
+func (p *pipeline) traits(hash []byte, size int) *avatarTraits {
+	if p.streams {
+		return pickTraits(newHashStream(hash), size, p.shapedHeads)
+	}
+	return pickTraits(newByteRNG(hash), size, p.shapedHeads)
+}
+
+func (p *pipeline) render(c canvas, hash []byte) {
+	p.draw(c, p.traits(hash, c.Size()))
+}
+
+func (p *pipeline) draw(c canvas, t *avatarTraits) {
+	for _, l := range p.layers {
+		p.drawLayer(c, l, t)
+	}
+	c.SetBlendMode(blendNormal)
+}
+
+func (p *pipeline) drawLayer(c canvas, l Layer, t *avatarTraits) {
+	mode := l.Blend()
+	if p.overwrite && mode == blendNormal {
+		mode = blendReplace
+	}
+	c.SetBlendMode(mode)
+	if p.masks[l.Name()] {
+		c.BeginMask(l.Name())
+		defer c.EndMask()
+	}
+	if clip := l.Clip(); clip.mask != "" {
+		c.PushMask(clip.mask, clip.invert)
+		defer c.PopClip()
+	}
+	l.Draw(c, t)
+}
+
+// parseLayerZ reads -layer-z values such as "hood:95,mask:300".
+func parseLayerZ(raw string) (map[string]int, error) {
+	overrides := map[string]int{}
+	for _, entry := range parseNameList(raw) {
+		name, value, ok := strings.Cut(entry, ":")
+		z, err := strconv.Atoi(value)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("invalid layer z-order %q, want name:z", entry)
+		}
+		overrides[name] = z
+	}
+	return overrides, nil
+}
+
+// parseLayerBlend reads -layer-blend values such as "blush:multiply".
+func parseLayerBlend(raw string) (map[string]blendMode, error) {
+	overrides := map[string]blendMode{}
+	for _, entry := range parseNameList(raw) {
+		name, value, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid layer blend mode %q, want name:mode", entry)
+		}
+		mode, err := parseBlendMode(value)
+		if err != nil {
+			return nil, err
+		}
+		overrides[name] = mode
+	}
+	return overrides, nil
+}
+
+// parseLayerClip reads -layer-clip values such as "hair:head,hood:!head",
+// where a leading ! clips to the outside of the mask layer.
+func parseLayerClip(raw string) (map[string]layerClip, error) {
+	overrides := map[string]layerClip{}
+	for _, entry := range parseNameList(raw) {
+		name, mask, ok := strings.Cut(entry, ":")
+		clip := layerClip{mask: strings.TrimPrefix(mask, "!"), invert: strings.HasPrefix(mask, "!")}
+		if !ok || clip.mask == "" {
+			return nil, fmt.Errorf("invalid layer clip %q, want name:mask or name:!mask", entry)
+		}
+		overrides[name] = clip
+	}
+	return overrides, nil
+}
+
+func parseNameList(raw string) []string {
+	var names []string
+	for _, name := range strings.Split(raw, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
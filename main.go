@@ -1,83 +1,169 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"expvar"
+	"flag"
 	"image"
 	"image/color"
-	"image/draw"
 	"image/png"
+	"io"
 	"log"
 	"math"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
 const (
 	defaultSize = 64
-	maxSize     = 128
+	// referenceSize is the largest size the hand-tuned pixel constants were
+	// designed for; the service drew both 64 and 128 pixel avatars with them.
+	referenceSize = 128
 )
 
 func main() {
-	http.HandleFunc("/avatar", avatarHandler)
+	if len(os.Args) > 1 && os.Args[1] == "sign" {
+		if err := runSign(os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		if err := runVerify(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	cfg.loadEnv()
+	cfg.registerFlags(flag.CommandLine)
+	flag.Parse()
+	cfg.signingKeys = parseSigningKeys(os.Getenv(signingKeysEnv))
+	cfg.apiKeys = parseSigningKeys(os.Getenv(apiKeysEnv))
+	if err := cfg.validate(); err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+	pipelines, err := buildPipelines(cfg.layers)
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+	activePipelines = pipelines
+	if err := setupLogging(); err != nil {
+		log.Fatal(err)
+	}
 
-	addr := ":8080"
-	log.Printf("avatar service listening on %s", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
+	ls, err := listeners()
+	if err != nil {
+		log.Fatalf("listen: %v", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	go func() {
+		runSelfTest()
+		selfTestLoop(ctx, cfg.selfTestEvery)
+	}()
+	if err := serve(ctx, newServer(newMux()), ls); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatalf("server error: %v", err)
 	}
 }
 
+func newMux() http.Handler {
+	limiter := newRateLimiter(cfg.rateLimit, cfg.rateBurst)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /avatar", instrument("/avatar", limiter.limit(avatarHandler)))
+	mux.HandleFunc("GET /avatar/traits", instrument("/avatar/traits", limiter.limit(traitsHandler)))
+	mux.HandleFunc("GET /avatar/srcset", instrument("/avatar/srcset", limiter.limit(srcsetHandler)))
+	mux.HandleFunc("GET /avatar/{input}", instrument("/avatar/{input}", limiter.limit(avatarPathHandler)))
+	mux.HandleFunc("GET /avatar/{input}/{file}", instrument("/avatar/{input}/{file}", limiter.limit(avatarPathHandler)))
+	mux.HandleFunc("POST /avatars", instrument("/avatars", limiter.limit(batchHandler)))
+	mux.HandleFunc("GET /metrics", metricsHandler)
+	mux.HandleFunc("GET /healthz", healthzHandler)
+	mux.HandleFunc("GET /readyz", readyzHandler)
+	mux.Handle("GET /debug/vars", expvar.Handler())
+	return withCORS(mux)
+}
+
 func avatarHandler(w http.ResponseWriter, r *http.Request) {
-	input := strings.TrimSpace(r.URL.Query().Get("input"))
-	if input == "" {
-		http.Error(w, "missing input query parameter", http.StatusBadRequest)
+	req, err := parseAvatarRequest(imageParams(r))
+	if err != nil {
+		http.Error(w, err.Error(), requestStatus(err))
 		return
 	}
+	serveAvatar(w, r, req)
+}
 
-	size := defaultSize
-	if sizeParam := r.URL.Query().Get("size"); sizeParam != "" {
-		parsed, err := strconv.Atoi(sizeParam)
-		if err != nil {
-			http.Error(w, "invalid size", http.StatusBadRequest)
-			return
-		}
-		size = parsed
-	}
-	if size != defaultSize && size != maxSize {
-		http.Error(w, "size must be 64 or 128", http.StatusBadRequest)
+// avatarPathHandler serves /avatar/{input} and /avatar/{input}/{size}.{ext}.
+// Path segments take precedence over the equivalent query parameters, which
+// remain available for everything the path does not carry. A bare MD5 or
+// SHA-256 hex input is treated as a Gravatar URL.
+func avatarPathHandler(w http.ResponseWriter, r *http.Request) {
+	if m := gravatarPath.FindStringSubmatch(r.PathValue("input")); m != nil && r.PathValue("file") == "" {
+		gravatarHandler(w, r, m[1], m[2])
 		return
 	}
-
-	timeKey, err := resolveTimeKey(r.URL.Query().Get("timestamp"))
+	req, err := parseAvatarRequest(imageParams(r).withPath(r.PathValue("input"), r.PathValue("file")))
 	if err != nil {
-		http.Error(w, "invalid timestamp", http.StatusBadRequest)
+		http.Error(w, err.Error(), requestStatus(err))
 		return
 	}
+	serveAvatar(w, r, req)
+}
 
-	hash := hashInput(input, timeKey)
-	img := generateAvatar(hash, size)
+func serveAvatar(w http.ResponseWriter, r *http.Request, req avatarRequest) {
+	hash := req.hash()
+	labelRequest(r, req.size, string(req.format))
+	labelInput(r, req.input, hash)
+	etag := avatarETag(hash, req.size, req.format, req.render)
 
-	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Type", formatMediaTypes[req.format])
+	w.Header().Add("Vary", "Accept")
 	w.Header().Set("X-Avatar-Hash", hex.EncodeToString(hash))
-	w.Header().Set("X-Avatar-Time-Key", timeKey)
-	if err := png.Encode(w, img); err != nil {
+	w.Header().Set("X-Avatar-Time-Key", req.window.key)
+	w.Header().Set("X-Avatar-Version", strconv.Itoa(req.render.version))
+	setCacheHeaders(w.Header(), etag, req.window, time.Now())
+	if notModified(r, etag, req.window.start) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := encodeAvatar(w, hash, req); err != nil {
 		http.Error(w, "failed to encode image", http.StatusInternalServerError)
 		return
 	}
 }
 
-func resolveTimeKey(raw string) (string, error) {
-	if raw == "" {
-		return time.Now().UTC().Format("2006-01-02"), nil
+func encodeAvatar(w io.Writer, hash []byte, req avatarRequest) error {
+	start := time.Now()
+	if req.format == formatSVG {
+		svg := generateAvatarSVG(hash, req.size, req.render)
+		renderSeconds.since(start, string(formatSVG))
+		_, err := w.Write(svg)
+		return err
 	}
-	parsed, err := strconv.ParseInt(raw, 10, 64)
-	if err != nil {
-		return "", err
+	img := generateAvatar(hash, req.size, req.render)
+	renderSeconds.since(start, string(formatPNG))
+
+	// Encode into memory so the histogram measures png.Encode rather than
+	// the client's download speed.
+	var buf bytes.Buffer
+	start = time.Now()
+	if err := png.Encode(&buf, img); err != nil {
+		return err
 	}
-	return time.Unix(parsed, 0).UTC().Format("2006-01-02"), nil
+	pngEncodeSeconds.since(start)
+	_, err := w.Write(buf.Bytes())
+	return err
 }
 
 func hashInput(input string, timeKey string) []byte {
@@ -85,86 +171,78 @@ func hashInput(input string, timeKey string) []byte {
 	return h[:]
 }
 
-func generateAvatar(hash []byte, size int) image.Image {
-	img := image.NewRGBA(image.Rect(0, 0, size, size))
-	rng := newByteRNG(hash)
-	background := blendColor(pickColor(rng, backgroundPalette), 0.08)
-	draw.Draw(img, img.Bounds(), &image.Uniform{C: background}, image.Point{}, draw.Src)
-
-	center := image.Point{X: size / 2, Y: size / 2}
-	headRadius := int(float64(size) * (0.32 + 0.06*float64(rng.nextInt(4))))
-	skin := pickColor(rng, skinPalette)
-	hair := pickColor(rng, hairPalette)
-	eye := pickColor(rng, eyePalette)
-	mouth := pickColor(rng, mouthPalette)
-	highlight := blendColor(skin, 0.2)
-	accessory := pickColor(rng, accessoryPalette)
-	brow := pickColor(rng, eyebrowPalette)
-	blush := pickColor(rng, blushPalette)
-	neck := pickColor(rng, neckPalette)
-	clothing := pickColor(rng, clothingPalette)
-	accent := pickColor(rng, accentPalette)
-	scar := pickColor(rng, scarPalette)
-	mask := pickColor(rng, maskPalette)
-	lip := pickColor(rng, lipPalette)
-	shadow := pickColor(rng, shadowPalette)
-	frame := pickColor(rng, framePalette)
-	mark := pickColor(rng, markPalette)
-	hood := pickColor(rng, hoodPalette)
-	irisHighlight := pickColor(rng, irisHighlightPalette)
-	cape := pickColor(rng, capePalette)
-
-	drawFilledCircle(img, center, headRadius, skin)
-	drawFilledCircle(img, image.Point{X: center.X - headRadius/3, Y: center.Y + headRadius/5}, headRadius/6, highlight)
-	drawBackgroundGradient(img, background, accent)
-	drawHair(img, center, headRadius, hair, rng)
-	drawHairStrands(img, center, headRadius, blendColor(hair, 0.2), rng)
-	drawSideburns(img, center, headRadius, hair, rng)
-	drawNeck(img, center, headRadius, neck)
-	drawCape(img, center, headRadius, cape, rng)
-	drawShoulders(img, center, headRadius, clothing, accent, rng)
-	drawBackgroundAccents(img, center, headRadius, accent, rng)
-	drawFrameBorder(img, frame)
-	drawAccessories(img, center, headRadius, accessory, skin, rng)
-	drawMask(img, center, headRadius, mask, rng)
-	drawEyes(img, center, headRadius, eye, rng)
-	drawIrisHighlights(img, center, headRadius, irisHighlight, rng)
-	drawEyebrows(img, center, headRadius, brow, rng)
-	drawNose(img, center, headRadius)
-	drawBlush(img, center, headRadius, blush, rng)
-	drawScar(img, center, headRadius, scar, rng)
-	drawMouth(img, center, headRadius, mouth, rng)
-	drawLipShine(img, center, headRadius, lip, rng)
-	drawMustache(img, center, headRadius, hair, rng)
-	drawChinShadow(img, center, headRadius, shadow, rng)
-	drawForeheadMark(img, center, headRadius, mark, rng)
-	drawHood(img, center, headRadius, hood, rng)
-	applyVignette(img, center, int(float64(size)*0.48))
-	applyNoise(img, rng, size/2)
+// renderOptions are the per-request choices that change how an avatar is
+// drawn without changing which avatar it is.
+type renderOptions struct {
+	version     int
+	antialias   bool
+	transparent bool
+	shape       cropShape
+	// dpr is the device pixel ratio; zero renders at the logical size.
+	dpr float64
+}
 
-	return img
+// pixels is the width and height an avatar of the given logical size is
+// rendered at.
+func (o renderOptions) pixels(size int) int {
+	if o.dpr == 0 {
+		return size
+	}
+	return int(math.Round(float64(size) * o.dpr))
 }
 
-type byteRNG struct {
-	data []byte
-	idx  int
+// key distinguishes the options in entity tags.
+func (o renderOptions) key() string {
+	var parts []string
+	if o.antialias {
+		parts = append(parts, "aa")
+	}
+	if o.transparent {
+		parts = append(parts, "bg=transparent")
+	}
+	if o.shape.crops() {
+		parts = append(parts, "shape="+string(o.shape))
+	}
+	if o.dpr != 0 && o.dpr != 1 {
+		parts = append(parts, "dpr="+formatDPR(o.dpr))
+	}
+	return strings.Join(parts, ",")
 }
 
-func newByteRNG(seed []byte) *byteRNG {
-	return &byteRNG{data: seed}
+func generateAvatar(hash []byte, size int, opts renderOptions) image.Image {
+	pixels := opts.pixels(size)
+	img := image.NewRGBA(image.Rect(0, 0, pixels, pixels))
+	c := newRasterCanvas(img)
+	if opts.antialias {
+		c = newSmoothRasterCanvas(img, cfg.aaSamples)
+	}
+	if pixels != size {
+		renderAvatar(&scaledCanvas{rasterCanvas: c, size: size, scale: float64(pixels) / float64(size)}, hash, opts)
+		return img
+	}
+	renderAvatar(c, hash, opts)
+	return img
 }
 
-func (r *byteRNG) nextByte() byte {
-	b := r.data[r.idx%len(r.data)]
-	r.idx++
-	return b
+func generateAvatarSVG(hash []byte, size int, opts renderOptions) []byte {
+	c := newSVGCanvas(size)
+	c.pixels = opts.pixels(size)
+	c.crisp = !opts.antialias
+	renderAvatar(c, hash, opts)
+	return c.Bytes()
 }
 
-func (r *byteRNG) nextInt(max int) int {
-	if max <= 0 {
-		return 0
+// renderAvatar draws the avatar and cuts it to the requested shape. A
+// transparent avatar leaves out everything drawn behind the face.
+func renderAvatar(c canvas, hash []byte, opts renderOptions) {
+	p := activePipelines[opts.version]
+	if opts.transparent {
+		p = p.without(backgroundLayers)
+	}
+	p.render(c, hash)
+	if opts.shape.crops() {
+		c.Crop(opts.shape)
 	}
-	return int(r.nextByte()) % max
 }
 
 var (
@@ -296,7 +374,7 @@ var (
 	}
 )
 
-func pickColor(rng *byteRNG, palette []color.RGBA) color.RGBA {
+func pickColor(rng randStream, palette []color.RGBA) color.RGBA {
 	return palette[rng.nextInt(len(palette))]
 }
 
@@ -307,600 +385,443 @@ func blendColor(c color.RGBA, factor float64) color.RGBA {
 	return color.RGBA{R: apply(c.R), G: apply(c.G), B: apply(c.B), A: c.A}
 }
 
-func drawFilledCircle(img *image.RGBA, center image.Point, radius int, fill color.RGBA) {
-	r2 := radius * radius
-	for y := center.Y - radius; y <= center.Y+radius; y++ {
-		for x := center.X - radius; x <= center.X+radius; x++ {
-			dx := x - center.X
-			dy := y - center.Y
-			if dx*dx+dy*dy <= r2 {
-				img.Set(x, y, fill)
-			}
-		}
-	}
+// pixelUnit is the stroke width, in pixels, of a one-pixel detail at referenceSize.
+func pixelUnit(size int) int {
+	return max(1, (size+referenceSize/2)/referenceSize)
 }
 
-func drawHair(img *image.RGBA, center image.Point, radius int, hair color.RGBA, rng *byteRNG) {
-	height := int(float64(radius) * (0.55 + 0.1*float64(rng.nextInt(3))))
-	top := center.Y - radius
-	for y := top; y < top+height; y++ {
-		for x := center.X - radius; x <= center.X+radius; x++ {
-			dx := x - center.X
-			dy := y - (center.Y - radius/2)
-			if dx*dx+dy*dy <= radius*radius {
-				img.Set(x, y, hair)
-			}
-		}
-	}
+func fillRect(c canvas, x0, y0, x1, y1 int, fill color.RGBA) {
+	c.FillRect(float64(x0), float64(y0), float64(x1), float64(y1), fill)
 }
 
-func drawAccessories(img *image.RGBA, center image.Point, radius int, accessory color.RGBA, skin color.RGBA, rng *byteRNG) {
-	switch rng.nextInt(5) {
-	case 0:
-		drawGlasses(img, center, radius, accessory, rng)
-	case 1:
-		drawHat(img, center, radius, accessory, rng)
-	case 2:
-		drawEarrings(img, center, radius, accessory)
-	case 3:
-		drawFreckles(img, center, radius, blendColor(skin, 0.4), rng)
-	default:
-		drawBeard(img, center, radius, accessory, rng)
-	}
+// plot fills a unit-by-unit block centred on (x, y).
+func plot(c canvas, x int, y int, unit int, fill color.RGBA) {
+	x -= (unit - 1) / 2
+	y -= (unit - 1) / 2
+	fillRect(c, x, y, x+unit, y+unit, fill)
 }
 
-func drawBackgroundGradient(img *image.RGBA, base color.RGBA, accent color.RGBA) {
-	bounds := img.Bounds()
-	for y := 0; y < bounds.Dy(); y++ {
-		t := float64(y) / float64(bounds.Dy())
-		blend := color.RGBA{
-			R: uint8(float64(base.R)*(1-t) + float64(accent.R)*t),
-			G: uint8(float64(base.G)*(1-t) + float64(accent.G)*t),
-			B: uint8(float64(base.B)*(1-t) + float64(accent.B)*t),
-			A: 255,
-		}
-		for x := 0; x < bounds.Dx(); x++ {
-			img.Set(x, y, blend)
-		}
-	}
+func drawFilledCircle(c canvas, center image.Point, radius int, fill color.RGBA) {
+	c.FillCircle(pt(center.X, center.Y), float64(radius), fill)
 }
 
-func drawHairStrands(img *image.RGBA, center image.Point, radius int, hair color.RGBA, rng *byteRNG) {
-	count := 8 + rng.nextInt(6)
-	for i := 0; i < count; i++ {
-		startX := center.X - radius + rng.nextInt(radius*2)
-		startY := center.Y - radius + rng.nextInt(radius/2)
-		length := radius/2 + rng.nextInt(radius/2)
-		for y := 0; y < length; y++ {
-			img.Set(startX, startY+y, hair)
-		}
-	}
+func drawHair(c canvas, center image.Point, radius int, top int, height int, hair color.RGBA) {
+	c.PushClipRect(0, float64(top), float64(c.Size()), float64(top+height))
+	drawFilledCircle(c, image.Point{X: center.X, Y: center.Y - radius/2}, radius, hair)
+	c.PopClip()
 }
 
-func drawSideburns(img *image.RGBA, center image.Point, radius int, hair color.RGBA, rng *byteRNG) {
-	if rng.nextInt(2) == 0 {
-		return
-	}
-	width := radius / 6
-	height := radius / 2
-	leftX := center.X - radius + width
-	rightX := center.X + radius - width
-	topY := center.Y - radius/4
-	for y := topY; y < topY+height; y++ {
-		for x := leftX; x < leftX+width; x++ {
-			img.Set(x, y, hair)
-		}
-		for x := rightX - width; x < rightX; x++ {
-			img.Set(x, y, hair)
-		}
+func drawAccessories(c canvas, face faceLayout, accessory color.RGBA, skin color.RGBA, traits accessoryTraits) {
+	switch traits.kind {
+	case accessoryGlasses:
+		drawGlasses(c, face, accessory, traits.thickness)
+	case accessoryHat:
+		drawHat(c, face, accessory, traits.height)
+	case accessoryEarrings:
+		drawEarrings(c, face, accessory)
+	case accessoryFreckles:
+		drawFreckles(c, traits.freckles, blendColor(skin, 0.4))
 	}
 }
 
-func drawCape(img *image.RGBA, center image.Point, radius int, cape color.RGBA, rng *byteRNG) {
-	if rng.nextInt(3) != 0 {
-		return
+func drawBackgroundGradient(c canvas, base color.RGBA, accent color.RGBA) {
+	size := float64(c.Size())
+	c.FillVerticalGradient(0, 0, size, size, base, accent)
+}
+
+func drawHairStrands(c canvas, strands []hairStrand, hair color.RGBA) {
+	unit := pixelUnit(c.Size())
+	for _, s := range strands {
+		left := s.start.X - (unit-1)/2
+		fillRect(c, left, s.start.Y, left+unit, s.start.Y+s.length, hair)
 	}
+}
+
+func drawSideburns(c canvas, face faceLayout, hair color.RGBA) {
+	center := face.center
+	width := face.radius / 6
+	height := face.radius / 2
+	leftX := center.X - face.sideburnX
+	rightX := center.X + face.sideburnX
+	topY := face.sideburnY
+	fillRect(c, leftX, topY, leftX+width, topY+height, hair)
+	fillRect(c, rightX-width, topY, rightX, topY+height, hair)
+}
+
+func drawCape(c canvas, center image.Point, radius int, cape color.RGBA) {
 	width := radius * 2
 	height := radius
 	startY := center.Y + radius + radius/4
 	for y := startY; y < startY+height; y++ {
-		offset := (y - startY) / 2
-		for x := center.X - width/2 - offset; x <= center.X+width/2+offset; x++ {
-			img.Set(x, y, cape)
-		}
+		flare := (y - startY) / 2
+		fillRect(c, center.X-width/2-flare, y, center.X+width/2+flare+1, y+1, cape)
 	}
 }
 
-func drawNeck(img *image.RGBA, center image.Point, radius int, neck color.RGBA) {
+func drawNeck(c canvas, center image.Point, radius int, neck color.RGBA) {
 	width := radius / 2
 	height := radius / 2
 	startX := center.X - width/2
 	startY := center.Y + radius/2
-	for y := startY; y < startY+height; y++ {
-		for x := startX; x < startX+width; x++ {
-			img.Set(x, y, neck)
-		}
-	}
+	fillRect(c, startX, startY, startX+width, startY+height, neck)
 }
 
-func drawShoulders(img *image.RGBA, center image.Point, radius int, clothing color.RGBA, accent color.RGBA, rng *byteRNG) {
-	width := radius * 2
-	height := radius / 2
-	startY := center.Y + radius
-	for y := startY; y < startY+height; y++ {
-		for x := center.X - width/2; x <= center.X+width/2; x++ {
-			img.Set(x, y, clothing)
-		}
-	}
-	if rng.nextInt(2) == 0 {
-		drawChevron(img, image.Point{X: center.X, Y: startY + height/3}, width/2, height/3, accent)
+func drawShoulders(c canvas, face faceLayout, clothing color.RGBA, accent color.RGBA, pattern shoulderPattern) {
+	center := face.center
+	width := face.radius * 2
+	height := face.radius / 2
+	startY := face.shoulderY
+	fillRect(c, center.X-width/2, startY, center.X+width/2+1, startY+height, clothing)
+	if pattern == shoulderChevron {
+		drawChevron(c, image.Point{X: center.X, Y: startY + height/3}, width/2, height/3, accent)
 	} else {
-		drawStripe(img, image.Point{X: center.X, Y: startY + height/3}, width/2, height/3, accent)
+		drawStripe(c, image.Point{X: center.X, Y: startY + height/3}, width/2, height/3, accent)
 	}
 }
 
-func drawBackgroundAccents(img *image.RGBA, center image.Point, radius int, accent color.RGBA, rng *byteRNG) {
-	switch rng.nextInt(6) {
-	case 0:
-		drawOrbitRings(img, center, radius, accent)
-	case 1:
-		drawStars(img, rng, radius, accent)
-	case 2:
-		drawHexGrid(img, center, radius, accent, rng)
-	case 3:
-		drawCircuitTrace(img, center, radius, accent, rng)
-	case 4:
-		drawConstellation(img, center, radius, accent, rng)
-	default:
-		drawAurora(img, center, radius, accent, rng)
+func drawBackgroundAccents(c canvas, center image.Point, radius int, accent color.RGBA, traits backgroundAccent) {
+	switch traits.kind {
+	case accentOrbitRings:
+		drawOrbitRings(c, center, radius, accent)
+	case accentStars:
+		drawStars(c, traits.stars, accent)
+	case accentHexGrid:
+		drawHexGrid(c, traits.hexagons, traits.hexRadius, accent)
+	case accentCircuitTrace:
+		drawCircuitTrace(c, traits.traces, accent)
+	case accentConstellation:
+		drawConstellation(c, traits.nodes, traits.nodeSizes, accent)
+	case accentAurora:
+		drawAurora(c, center, radius, traits.bands, traits.gridStep, accent)
 	}
 }
 
-func drawFrameBorder(img *image.RGBA, stroke color.RGBA) {
-	bounds := img.Bounds()
-	for x := bounds.Min.X; x < bounds.Max.X; x++ {
-		img.Set(x, bounds.Min.Y, stroke)
-		img.Set(x, bounds.Max.Y-1, stroke)
-	}
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		img.Set(bounds.Min.X, y, stroke)
-		img.Set(bounds.Max.X-1, y, stroke)
-	}
-	drawCornerTicks(img, stroke, 6)
+func drawFrameBorder(c canvas, stroke color.RGBA) {
+	size := c.Size()
+	unit := pixelUnit(size)
+	fillRect(c, 0, 0, size, unit, stroke)
+	fillRect(c, 0, size-unit, size, size, stroke)
+	fillRect(c, 0, unit, unit, size-unit, stroke)
+	fillRect(c, size-unit, unit, size, size-unit, stroke)
+	drawCornerTicks(c, stroke, 6*unit)
 }
 
-func drawEyes(img *image.RGBA, center image.Point, radius int, eye color.RGBA, rng *byteRNG) {
-	offsetX := radius / 2
-	offsetY := radius / 5
+func drawEyes(c canvas, face faceLayout, eye color.RGBA, shift int) {
+	center, radius := face.center, face.radius
 	eyeRadius := int(float64(radius) * 0.12)
 	white := color.RGBA{R: 248, G: 248, B: 248, A: 255}
 	pupilRadius := int(float64(eyeRadius) * 0.6)
-	eyeShift := rng.nextInt(3) - 1
+	eyeShift := shift * pixelUnit(c.Size())
 
-	left := image.Point{X: center.X - offsetX + eyeShift, Y: center.Y - offsetY}
-	right := image.Point{X: center.X + offsetX + eyeShift, Y: center.Y - offsetY}
-	drawFilledCircle(img, left, eyeRadius, white)
-	drawFilledCircle(img, right, eyeRadius, white)
-	drawFilledCircle(img, left, pupilRadius, eye)
-	drawFilledCircle(img, right, pupilRadius, eye)
+	left := image.Point{X: center.X - face.eyeX + eyeShift, Y: face.eyeY}
+	right := image.Point{X: center.X + face.eyeX + eyeShift, Y: face.eyeY}
+	drawFilledCircle(c, left, eyeRadius, white)
+	drawFilledCircle(c, right, eyeRadius, white)
+	drawFilledCircle(c, left, pupilRadius, eye)
+	drawFilledCircle(c, right, pupilRadius, eye)
 }
 
-func drawIrisHighlights(img *image.RGBA, center image.Point, radius int, highlight color.RGBA, rng *byteRNG) {
-	offsetX := radius / 2
-	offsetY := radius / 5
-	size := radius / 12
-	shift := rng.nextInt(2)
-	left := image.Point{X: center.X - offsetX + shift, Y: center.Y - offsetY - shift}
-	right := image.Point{X: center.X + offsetX + shift, Y: center.Y - offsetY - shift}
-	drawFilledCircle(img, left, size, highlight)
-	drawFilledCircle(img, right, size, highlight)
+func drawIrisHighlights(c canvas, face faceLayout, highlight color.RGBA, shift int) {
+	center := face.center
+	size := face.radius / 12
+	shift *= pixelUnit(c.Size())
+	left := image.Point{X: center.X - face.eyeX + shift, Y: face.eyeY - shift}
+	right := image.Point{X: center.X + face.eyeX + shift, Y: face.eyeY - shift}
+	drawFilledCircle(c, left, size, highlight)
+	drawFilledCircle(c, right, size, highlight)
 }
 
-func drawEyebrows(img *image.RGBA, center image.Point, radius int, brow color.RGBA, rng *byteRNG) {
+func drawEyebrows(c canvas, face faceLayout, brow color.RGBA, tilt int) {
+	center, radius := face.center, face.radius
 	width := radius / 2
 	height := radius / 10
-	offsetX := radius / 2
-	offsetY := radius / 3
-	tilt := rng.nextInt(5) - 2
-	drawSlantedRect(img, image.Point{X: center.X - offsetX, Y: center.Y - offsetY}, width, height, tilt, brow)
-	drawSlantedRect(img, image.Point{X: center.X + offsetX, Y: center.Y - offsetY}, width, height, -tilt, brow)
+	tilt *= pixelUnit(c.Size())
+	drawSlantedRect(c, image.Point{X: center.X - face.eyeX, Y: face.browY}, width, height, tilt, brow)
+	drawSlantedRect(c, image.Point{X: center.X + face.eyeX, Y: face.browY}, width, height, -tilt, brow)
 }
 
-func drawGlasses(img *image.RGBA, center image.Point, radius int, frame color.RGBA, rng *byteRNG) {
-	eyeOffsetX := radius / 2
-	eyeOffsetY := radius / 5
+func drawGlasses(c canvas, face faceLayout, frame color.RGBA, thickness int) {
+	center, radius := face.center, face.radius
 	lensWidth := radius / 2
 	lensHeight := radius / 3
 	bridge := radius / 8
-	thickness := 2 + rng.nextInt(2)
+	thickness *= pixelUnit(c.Size())
 
-	left := image.Point{X: center.X - eyeOffsetX, Y: center.Y - eyeOffsetY}
-	right := image.Point{X: center.X + eyeOffsetX, Y: center.Y - eyeOffsetY}
+	left := image.Point{X: center.X - face.eyeX, Y: face.eyeY}
+	right := image.Point{X: center.X + face.eyeX, Y: face.eyeY}
 
-	drawRectOutline(img, left, lensWidth, lensHeight, thickness, frame)
-	drawRectOutline(img, right, lensWidth, lensHeight, thickness, frame)
-	for x := left.X + lensWidth/2; x < left.X+lensWidth/2+bridge; x++ {
-		for t := -thickness; t <= thickness; t++ {
-			img.Set(x, left.Y+t, frame)
-		}
-	}
+	drawRectOutline(c, left, lensWidth, lensHeight, thickness, frame)
+	drawRectOutline(c, right, lensWidth, lensHeight, thickness, frame)
+	bridgeX := left.X + lensWidth/2
+	fillRect(c, bridgeX, left.Y-thickness, bridgeX+bridge, left.Y+thickness+1, frame)
 }
 
-func drawMask(img *image.RGBA, center image.Point, radius int, mask color.RGBA, rng *byteRNG) {
-	if rng.nextInt(4) != 0 {
-		return
-	}
-	width := int(float64(radius) * 1.4)
-	height := radius / 2
-	startY := center.Y + radius/4
-	for y := startY; y < startY+height; y++ {
-		for x := center.X - width/2; x <= center.X+width/2; x++ {
-			img.Set(x, y, mask)
-		}
-	}
-	stripe := blendColor(mask, 0.15)
-	for x := center.X - width/2; x <= center.X+width/2; x++ {
-		img.Set(x, startY+height/2, stripe)
-	}
+func drawMask(c canvas, face faceLayout, mask color.RGBA) {
+	center := face.center
+	width := face.maskWidth
+	height := face.radius / 2
+	startY := face.maskY
+	fillRect(c, center.X-width/2, startY, center.X+width/2+1, startY+height, mask)
+	unit := pixelUnit(c.Size())
+	stripeY := startY + height/2 - (unit-1)/2
+	fillRect(c, center.X-width/2, stripeY, center.X+width/2+1, stripeY+unit, blendColor(mask, 0.15))
 }
 
-func drawMustache(img *image.RGBA, center image.Point, radius int, hair color.RGBA, rng *byteRNG) {
-	if rng.nextInt(3) != 0 {
-		return
-	}
-	width := radius / 2
-	height := radius / 8
-	startY := center.Y + radius/6
-	for y := 0; y < height; y++ {
-		for x := -width; x <= width; x++ {
-			if x < 0 {
-				img.Set(center.X+x, startY+y, hair)
-			}
-			if x > 0 {
-				img.Set(center.X+x, startY+y, hair)
-			}
-		}
-	}
+func drawMustache(c canvas, face faceLayout, hair color.RGBA) {
+	center := face.center
+	width := face.mustacheWidth
+	height := face.radius / 8
+	startY := face.mustacheY
+	gap := pixelUnit(c.Size())
+	fillRect(c, center.X-width, startY, center.X-gap/2, startY+height, hair)
+	fillRect(c, center.X+gap-gap/2, startY, center.X+width+1, startY+height, hair)
 }
 
-func drawChinShadow(img *image.RGBA, center image.Point, radius int, shadow color.RGBA, rng *byteRNG) {
-	if rng.nextInt(2) != 0 {
-		return
-	}
-	width := radius / 2
-	height := radius / 4
-	startY := center.Y + radius/2
-	for y := 0; y < height; y++ {
-		for x := -width; x <= width; x++ {
-			if x*x+y*y <= width*width {
-				img.Set(center.X+x, startY+y, shadow)
-			}
-		}
-	}
+func drawChinShadow(c canvas, face faceLayout, shadow color.RGBA) {
+	center := face.center
+	width := face.radius / 2
+	height := face.radius / 4
+	startY := face.chinY
+	c.PushClipRect(0, float64(startY), float64(c.Size()), float64(startY+height))
+	drawFilledCircle(c, image.Point{X: center.X, Y: startY}, width, shadow)
+	c.PopClip()
 }
 
-func drawForeheadMark(img *image.RGBA, center image.Point, radius int, mark color.RGBA, rng *byteRNG) {
-	if rng.nextInt(4) != 0 {
-		return
-	}
-	size := radius / 6
-	startY := center.Y - radius/2
-	drawDiamond(img, image.Point{X: center.X, Y: startY}, size, mark)
+func drawForeheadMark(c canvas, face faceLayout, mark color.RGBA) {
+	size := face.radius / 6
+	drawDiamond(c, image.Point{X: face.center.X, Y: face.markY}, size, mark)
 }
 
-func drawHood(img *image.RGBA, center image.Point, radius int, hood color.RGBA, rng *byteRNG) {
-	if rng.nextInt(3) != 0 {
-		return
-	}
+func drawHood(c canvas, face faceLayout, hood color.RGBA) {
+	center, radius := face.center, face.radius
 	width := radius * 2
 	height := radius + radius/2
-	startY := center.Y - radius
-	for y := startY; y < startY+height; y++ {
-		for x := center.X - width/2; x <= center.X+width/2; x++ {
-			dx := float64(x - center.X)
-			dy := float64(y - (center.Y - radius/3))
-			if (dx*dx)/(float64(width*width)/4)+(dy*dy)/(float64(height*height)/4) <= 1 {
-				if img.RGBAAt(x, y).A != 0 {
-					img.Set(x, y, blendColor(hood, 0.05))
-				}
-			}
-		}
-	}
+	startY := face.top
+	c.PushClipRect(0, float64(startY), float64(c.Size()), float64(startY+height))
+	c.FillEllipse(pt(center.X, startY+radius-radius/3), float64(width)/2, float64(height)/2, blendColor(hood, 0.05))
+	c.PopClip()
 }
 
-func drawHat(img *image.RGBA, center image.Point, radius int, hat color.RGBA, rng *byteRNG) {
-	height := radius/2 + rng.nextInt(radius/4)
-	top := center.Y - radius - height/3
+// drawHat sits the hat's crown and brim on the top of the head.
+func drawHat(c canvas, face faceLayout, hat color.RGBA, height int) {
+	center, radius := face.center, face.radius
+	top := face.top - height/3
 	brimHeight := radius / 10
 	brimWidth := radius + radius/2
-	for y := top; y < top+height; y++ {
-		for x := center.X - radius; x <= center.X+radius; x++ {
-			dx := x - center.X
-			dy := y - (center.Y - radius)
-			if dx*dx+dy*dy <= radius*radius {
-				img.Set(x, y, hat)
-			}
-		}
-	}
-	for y := center.Y - radius; y < center.Y-radius+brimHeight; y++ {
-		for x := center.X - brimWidth/2; x <= center.X+brimWidth/2; x++ {
-			img.Set(x, y, hat)
-		}
-	}
+	c.PushClipRect(0, float64(top), float64(c.Size()), float64(top+height))
+	drawFilledCircle(c, image.Point{X: center.X, Y: face.top}, radius, hat)
+	c.PopClip()
+	fillRect(c, center.X-brimWidth/2, face.top, center.X+brimWidth/2+1, face.top+brimHeight, hat)
 }
 
-func drawEarrings(img *image.RGBA, center image.Point, radius int, jewel color.RGBA) {
-	offsetX := radius * 5 / 6
-	offsetY := radius / 10
-	size := radius / 8
-	drawFilledCircle(img, image.Point{X: center.X - offsetX, Y: center.Y + offsetY}, size, jewel)
-	drawFilledCircle(img, image.Point{X: center.X + offsetX, Y: center.Y + offsetY}, size, jewel)
+func drawEarrings(c canvas, face faceLayout, jewel color.RGBA) {
+	center := face.center
+	size := face.radius / 8
+	drawFilledCircle(c, image.Point{X: center.X - face.earringX, Y: face.earringY}, size, jewel)
+	drawFilledCircle(c, image.Point{X: center.X + face.earringX, Y: face.earringY}, size, jewel)
 }
 
-func drawFreckles(img *image.RGBA, center image.Point, radius int, freckle color.RGBA, rng *byteRNG) {
-	count := 6 + rng.nextInt(8)
-	for i := 0; i < count; i++ {
-		x := center.X - radius/2 + rng.nextInt(radius)
-		y := center.Y + rng.nextInt(radius/3)
-		img.Set(x, y, freckle)
+func drawFreckles(c canvas, freckles []image.Point, freckle color.RGBA) {
+	unit := pixelUnit(c.Size())
+	for _, p := range freckles {
+		plot(c, p.X, p.Y, unit, freckle)
 	}
 }
 
-func drawScar(img *image.RGBA, center image.Point, radius int, scar color.RGBA, rng *byteRNG) {
-	if rng.nextInt(4) != 0 {
-		return
-	}
-	length := radius / 2
-	startX := center.X - length/2
-	startY := center.Y - radius/6
-	angle := float64(rng.nextInt(5)-2) * 0.2
+func drawScar(c canvas, face faceLayout, scar color.RGBA, slope float64) {
+	length := face.scarLength
+	startX := face.center.X - length/2
+	startY := face.scarY
+	unit := pixelUnit(c.Size())
 	for i := 0; i < length; i++ {
-		x := startX + i
-		y := startY + int(float64(i)*angle)
-		img.Set(x, y, scar)
+		plot(c, startX+i, startY+int(float64(i)*slope), unit, scar)
 	}
 }
 
-func drawBeard(img *image.RGBA, center image.Point, radius int, beard color.RGBA, rng *byteRNG) {
-	height := radius/2 + rng.nextInt(radius/4)
+func drawBeard(c canvas, center image.Point, radius int, beard color.RGBA, height int) {
 	startY := center.Y + radius/4
-	for y := startY; y < startY+height; y++ {
-		for x := center.X - radius/2; x <= center.X+radius/2; x++ {
-			dx := x - center.X
-			dy := y - (center.Y + radius/3)
-			if dx*dx+dy*dy <= radius*radius/2 {
-				img.Set(x, y, beard)
-			}
-		}
-	}
+	c.PushClipRect(float64(center.X-radius/2), float64(startY), float64(center.X+radius/2+1), float64(startY+height))
+	// The beard covers the pixels within radius²/2, rounded down, of its
+	// centre; half a unit more keeps rounding off the edge pixels.
+	c.FillCircle(pt(center.X, center.Y+radius/3), math.Sqrt(float64(radius*radius/2)+0.5), beard)
+	c.PopClip()
 }
 
-func drawNose(img *image.RGBA, center image.Point, radius int) {
+func drawNose(c canvas, face faceLayout) {
 	noseColor := color.RGBA{R: 180, G: 120, B: 90, A: 255}
-	height := int(float64(radius) * 0.25)
-	for y := 0; y < height; y++ {
+	height := int(float64(face.radius) * 0.25)
+	// The nose narrows over height steps drawn two to a row, and the first
+	// of each pair is the wider.
+	for y := 0; y < height; y += 2 {
 		width := int(float64(height-y) * 0.3)
-		for x := -width; x <= width; x++ {
-			img.Set(center.X+x, center.Y+y/2, noseColor)
-		}
+		row := face.noseY + y/2
+		fillRect(c, face.center.X-width, row, face.center.X+width+1, row+1, noseColor)
 	}
 }
 
-func drawBlush(img *image.RGBA, center image.Point, radius int, blush color.RGBA, rng *byteRNG) {
-	if rng.nextInt(3) == 0 {
-		return
-	}
-	offsetX := radius / 2
-	offsetY := radius / 6
-	size := radius / 6
-	drawFilledCircle(img, image.Point{X: center.X - offsetX, Y: center.Y + offsetY}, size, blush)
-	drawFilledCircle(img, image.Point{X: center.X + offsetX, Y: center.Y + offsetY}, size, blush)
+func drawBlush(c canvas, face faceLayout, blush color.RGBA) {
+	center := face.center
+	size := face.radius / 6
+	drawFilledCircle(c, image.Point{X: center.X - face.cheekX, Y: face.cheekY}, size, blush)
+	drawFilledCircle(c, image.Point{X: center.X + face.cheekX, Y: face.cheekY}, size, blush)
 }
 
-func drawMouth(img *image.RGBA, center image.Point, radius int, mouth color.RGBA, rng *byteRNG) {
-	width := int(float64(radius) * 0.7)
-	curve := float64(rng.nextInt(6)-2) / 10.0
-	baseY := float64(center.Y) + float64(radius)/3.0
+func drawMouth(c canvas, face faceLayout, mouth color.RGBA, curve float64) {
+	center, radius := face.center, face.radius
+	baseY := face.mouthY
 	thickness := int(float64(radius) * 0.08)
 
-	for x := -width / 2; x <= width/2; x++ {
-		xf := float64(x) / float64(width/2)
-		y := baseY + curve*math.Pow(xf, 2)*float64(radius)*1.2
-		for t := -thickness; t <= thickness; t++ {
-			img.Set(center.X+x, int(y)+t, mouth)
-		}
+	half := int(face.mouthHalf)
+	for x := -half; x <= half; x++ {
+		xf := float64(x) / face.mouthHalf
+		y := int(baseY + curve*math.Pow(xf, 2)*float64(radius)*1.2)
+		fillRect(c, center.X+x, y-thickness, center.X+x+1, y+thickness+1, mouth)
 	}
 }
 
-func drawLipShine(img *image.RGBA, center image.Point, radius int, lip color.RGBA, rng *byteRNG) {
-	if rng.nextInt(2) == 0 {
-		return
-	}
-	width := radius / 3
-	height := radius / 20
-	startY := center.Y + radius/3
-	for y := 0; y < height; y++ {
-		for x := -width / 2; x <= width/2; x++ {
-			img.Set(center.X+x, startY+y, lip)
-		}
-	}
+func drawLipShine(c canvas, face faceLayout, lip color.RGBA) {
+	center := face.center
+	width := face.lipWidth
+	height := face.radius / 20
+	startY := face.lipY
+	fillRect(c, center.X-width/2, startY, center.X+width/2+1, startY+height, lip)
 }
 
-func drawRectOutline(img *image.RGBA, center image.Point, width int, height int, thickness int, stroke color.RGBA) {
+func drawRectOutline(c canvas, center image.Point, width int, height int, thickness int, stroke color.RGBA) {
 	left := center.X - width/2
-	right := center.X + width/2
+	right := center.X + width/2 + 1
 	top := center.Y - height/2
-	bottom := center.Y + height/2
-	for t := 0; t < thickness; t++ {
-		for x := left; x <= right; x++ {
-			img.Set(x, top+t, stroke)
-			img.Set(x, bottom-t, stroke)
-		}
-		for y := top; y <= bottom; y++ {
-			img.Set(left+t, y, stroke)
-			img.Set(right-t, y, stroke)
-		}
-	}
-}
-
-func drawDiamond(img *image.RGBA, center image.Point, radius int, fill color.RGBA) {
-	for y := -radius; y <= radius; y++ {
-		for x := -radius; x <= radius; x++ {
-			if abs(x)+abs(y) <= radius {
-				img.Set(center.X+x, center.Y+y, fill)
-			}
-		}
-	}
-}
-
-func drawSlantedRect(img *image.RGBA, center image.Point, width int, height int, slope int, fill color.RGBA) {
+	bottom := center.Y + height/2 + 1
+	fillRect(c, left, top, right, top+thickness, stroke)
+	fillRect(c, left, bottom-thickness, right, bottom, stroke)
+	fillRect(c, left, top+thickness, left+thickness, bottom-thickness, stroke)
+	fillRect(c, right-thickness, top+thickness, right, bottom-thickness, stroke)
+}
+
+func drawDiamond(c canvas, center image.Point, radius int, fill color.RGBA) {
+	cx := float64(center.X)
+	cy := float64(center.Y)
+	r := float64(radius) + 0.5
+	c.FillPolygon([]vec{
+		{X: cx, Y: cy - r},
+		{X: cx + r, Y: cy},
+		{X: cx, Y: cy + r},
+		{X: cx - r, Y: cy},
+	}, fill)
+}
+
+func drawSlantedRect(c canvas, center image.Point, width int, height int, slope int, fill color.RGBA) {
 	left := center.X - width/2
 	top := center.Y - height/2
 	for y := 0; y < height; y++ {
 		shift := (y * slope) / height
-		for x := 0; x < width; x++ {
-			img.Set(left+x+shift, top+y, fill)
-		}
+		fillRect(c, left+shift, top+y, left+shift+width, top+y+1, fill)
 	}
 }
 
-func drawChevron(img *image.RGBA, center image.Point, width int, height int, fill color.RGBA) {
+func drawChevron(c canvas, center image.Point, width int, height int, fill color.RGBA) {
 	for y := 0; y < height; y++ {
-		offset := int(float64(y) * 0.8)
-		for x := -width/2 + offset; x <= width/2-offset; x++ {
-			img.Set(center.X+x, center.Y+y, fill)
+		inset := int(float64(y) * 0.8)
+		if inset > width/2 {
+			break
 		}
+		fillRect(c, center.X-width/2+inset, center.Y+y, center.X+width/2-inset+1, center.Y+y+1, fill)
 	}
 }
 
-func drawStripe(img *image.RGBA, center image.Point, width int, height int, fill color.RGBA) {
-	for y := 0; y < height; y++ {
-		if y%2 == 0 {
-			for x := -width / 2; x <= width/2; x++ {
-				img.Set(center.X+x, center.Y+y, fill)
-			}
-		}
+func drawStripe(c canvas, center image.Point, width int, height int, fill color.RGBA) {
+	unit := pixelUnit(c.Size())
+	for y := 0; y < height; y += 2 * unit {
+		fillRect(c, center.X-width/2, center.Y+y, center.X+width/2+1, center.Y+y+unit, fill)
 	}
 }
 
-func drawOrbitRings(img *image.RGBA, center image.Point, radius int, accent color.RGBA) {
+// drawOrbitRings plots the ring at π/64 steps, which larger units divide so
+// the ring stays as dense as the radius grows.
+func drawOrbitRings(c canvas, center image.Point, radius int, accent color.RGBA) {
 	ringRadius := radius + radius/2
-	for angle := 0.0; angle < 2*math.Pi; angle += math.Pi / 64 {
+	unit := pixelUnit(c.Size())
+	step := math.Pi / float64(64*unit)
+	for angle := 0.0; angle < 2*math.Pi; angle += step {
 		x := center.X + int(float64(ringRadius)*math.Cos(angle))
 		y := center.Y + int(float64(ringRadius)*math.Sin(angle)*0.5)
-		img.Set(x, y, accent)
+		plot(c, x, y, unit, accent)
 	}
 }
 
-func drawStars(img *image.RGBA, rng *byteRNG, radius int, accent color.RGBA) {
-	count := 12 + rng.nextInt(10)
-	for i := 0; i < count; i++ {
-		x := rng.nextInt(radius*2) + radius/2
-		y := rng.nextInt(radius*2) + radius/2
-		img.Set(x, y, accent)
+func drawStars(c canvas, stars []image.Point, accent color.RGBA) {
+	unit := pixelUnit(c.Size())
+	for _, s := range stars {
+		plot(c, s.X, s.Y, unit, accent)
 	}
 }
 
-func drawCircuitTrace(img *image.RGBA, center image.Point, radius int, accent color.RGBA, rng *byteRNG) {
-	count := 4 + rng.nextInt(4)
-	for i := 0; i < count; i++ {
-		start := image.Point{
-			X: center.X - radius + rng.nextInt(radius*2),
-			Y: center.Y - radius + rng.nextInt(radius*2),
-		}
-		length := radius/2 + rng.nextInt(radius/2)
-		current := start
-		for j := 0; j < length; j++ {
-			img.Set(current.X, current.Y, accent)
-			switch rng.nextInt(4) {
-			case 0:
-				current.X++
-			case 1:
-				current.X--
-			case 2:
-				current.Y++
-			default:
-				current.Y--
-			}
-			if current.X < 0 || current.Y < 0 || current.X >= img.Bounds().Dx() || current.Y >= img.Bounds().Dy() {
-				break
-			}
+func drawCircuitTrace(c canvas, traces [][]image.Point, accent color.RGBA) {
+	unit := float64(pixelUnit(c.Size()))
+	for _, trace := range traces {
+		points := make([]vec, len(trace))
+		for i, p := range trace {
+			points[i] = pt(p.X, p.Y)
 		}
+		c.StrokePolyline(points, unit, accent)
 	}
 }
 
-func drawConstellation(img *image.RGBA, center image.Point, radius int, accent color.RGBA, rng *byteRNG) {
-	nodes := 6 + rng.nextInt(4)
-	points := make([]image.Point, 0, nodes)
-	for i := 0; i < nodes; i++ {
-		points = append(points, image.Point{
-			X: center.X - radius + rng.nextInt(radius*2),
-			Y: center.Y - radius + rng.nextInt(radius*2),
-		})
-	}
-	for i := 0; i < len(points); i++ {
-		drawLine(img, points[i], points[(i+1)%len(points)], accent)
-		drawFilledCircle(img, points[i], 1+rng.nextInt(2), accent)
+func drawConstellation(c canvas, nodes []image.Point, sizes []int, accent color.RGBA) {
+	unit := pixelUnit(c.Size())
+	for i, node := range nodes {
+		drawLine(c, node, nodes[(i+1)%len(nodes)], unit, accent)
+		drawFilledCircle(c, node, sizes[i]*unit, accent)
 	}
 }
 
-func drawAurora(img *image.RGBA, center image.Point, radius int, accent color.RGBA, rng *byteRNG) {
-	bands := 3 + rng.nextInt(3)
-	for i := 0; i < bands; i++ {
-		offset := rng.nextInt(radius) - radius/2
-		for x := center.X - radius; x <= center.X+radius; x++ {
+func drawAurora(c canvas, center image.Point, radius int, bands []int, gridStep int, accent color.RGBA) {
+	unit := pixelUnit(c.Size())
+	light := blendColor(accent, 0.3)
+	for _, offset := range bands {
+		for x := center.X - radius; x <= center.X+radius; x += unit {
 			y := center.Y - radius/2 + int(math.Sin(float64(x+offset)/float64(radius))*float64(radius)/4)
-			if y >= 0 && y < img.Bounds().Dy() {
-				img.Set(x, y, blendColor(accent, 0.3))
-				img.Set(x, y+1, accent)
+			if y >= 0 && y < c.Size() {
+				plot(c, x, y, unit, light)
+				plot(c, x, y+unit, unit, accent)
 			}
 		}
 	}
-	drawGridOverlay(img, center, radius, blendColor(accent, 0.4), rng)
+	drawGridOverlay(c, center, radius, gridStep, blendColor(accent, 0.4))
 }
 
-func drawGridOverlay(img *image.RGBA, center image.Point, radius int, accent color.RGBA, rng *byteRNG) {
-	step := 4 + rng.nextInt(4)
+func drawGridOverlay(c canvas, center image.Point, radius int, step int, accent color.RGBA) {
+	unit := pixelUnit(c.Size())
+	step *= unit
 	for y := center.Y - radius; y <= center.Y+radius; y += step {
-		for x := center.X - radius; x <= center.X+radius; x++ {
-			if x >= 0 && y >= 0 && x < img.Bounds().Dx() && y < img.Bounds().Dy() {
-				img.Set(x, y, accent)
-			}
-		}
+		fillRect(c, center.X-radius, y, center.X+radius+1, y+unit, accent)
 	}
 }
 
-func drawCornerTicks(img *image.RGBA, stroke color.RGBA, length int) {
-	bounds := img.Bounds()
-	for i := 0; i < length; i++ {
-		img.Set(bounds.Min.X+i, bounds.Min.Y, stroke)
-		img.Set(bounds.Min.X, bounds.Min.Y+i, stroke)
-		img.Set(bounds.Max.X-1-i, bounds.Min.Y, stroke)
-		img.Set(bounds.Max.X-1, bounds.Min.Y+i, stroke)
-		img.Set(bounds.Min.X+i, bounds.Max.Y-1, stroke)
-		img.Set(bounds.Min.X, bounds.Max.Y-1-i, stroke)
-		img.Set(bounds.Max.X-1-i, bounds.Max.Y-1, stroke)
-		img.Set(bounds.Max.X-1, bounds.Max.Y-1-i, stroke)
-	}
-}
-
-func drawHexGrid(img *image.RGBA, center image.Point, radius int, accent color.RGBA, rng *byteRNG) {
-	step := radius / 3
-	for y := center.Y - radius; y <= center.Y+radius; y += step {
-		rowShift := 0
-		if ((y - center.Y) / step % 2) != 0 {
-			rowShift = step / 2
+func drawCornerTicks(c canvas, stroke color.RGBA, length int) {
+	size := c.Size()
+	thickness := pixelUnit(size)
+	for _, corner := range []image.Point{{X: 0, Y: 0}, {X: size - length, Y: 0}, {X: 0, Y: size - length}, {X: size - length, Y: size - length}} {
+		edgeX := corner.X
+		if corner.X > 0 {
+			edgeX = size - thickness
 		}
-		for x := center.X - radius; x <= center.X+radius; x += step {
-			drawHexagon(img, image.Point{X: x + rowShift, Y: y}, step/3, accent, rng)
+		edgeY := corner.Y
+		if corner.Y > 0 {
+			edgeY = size - thickness
 		}
+		fillRect(c, corner.X, edgeY, corner.X+length, edgeY+thickness, stroke)
+		fillRect(c, edgeX, corner.Y, edgeX+thickness, corner.Y+length, stroke)
 	}
 }
 
-func drawHexagon(img *image.RGBA, center image.Point, radius int, accent color.RGBA, rng *byteRNG) {
-	if rng.nextInt(4) != 0 {
-		return
+func drawHexGrid(c canvas, hexagons []image.Point, radius int, accent color.RGBA) {
+	for _, center := range hexagons {
+		drawHexagon(c, center, radius, accent)
 	}
+}
+
+func drawHexagon(c canvas, center image.Point, radius int, accent color.RGBA) {
 	points := make([]image.Point, 0, 6)
 	for i := 0; i < 6; i++ {
 		angle := float64(i) * math.Pi / 3
@@ -909,29 +830,29 @@ func drawHexagon(img *image.RGBA, center image.Point, radius int, accent color.R
 			Y: center.Y + int(float64(radius)*math.Sin(angle)),
 		})
 	}
-	for i := 0; i < len(points); i++ {
-		drawLine(img, points[i], points[(i+1)%len(points)], accent)
+	unit := pixelUnit(c.Size())
+	for i := range points {
+		drawLine(c, points[i], points[(i+1)%len(points)], unit, accent)
 	}
 }
 
-func drawLine(img *image.RGBA, a image.Point, b image.Point, stroke color.RGBA) {
-	dx := int(math.Abs(float64(b.X - a.X)))
-	dy := -int(math.Abs(float64(b.Y - a.Y)))
-	sx := -1
+// drawLine steps from a to b with Bresenham's algorithm, plotting a
+// unit-by-unit block at each pixel.
+func drawLine(c canvas, a image.Point, b image.Point, unit int, stroke color.RGBA) {
+	dx := abs(b.X - a.X)
+	dy := -abs(b.Y - a.Y)
+	sx, sy := -1, -1
 	if a.X < b.X {
 		sx = 1
 	}
-	sy := -1
 	if a.Y < b.Y {
 		sy = 1
 	}
 	err := dx + dy
-	x := a.X
-	y := a.Y
-	for {
-		img.Set(x, y, stroke)
+	for x, y := a.X, a.Y; ; {
+		plot(c, x, y, unit, stroke)
 		if x == b.X && y == b.Y {
-			break
+			return
 		}
 		e2 := 2 * err
 		if e2 >= dy {
@@ -945,44 +866,6 @@ func drawLine(img *image.RGBA, a image.Point, b image.Point, stroke color.RGBA)
 	}
 }
 
-func applyVignette(img *image.RGBA, center image.Point, radius int) {
-	for y := 0; y < img.Bounds().Dy(); y++ {
-		for x := 0; x < img.Bounds().Dx(); x++ {
-			dx := float64(x - center.X)
-			dy := float64(y - center.Y)
-			dist := math.Sqrt(dx*dx + dy*dy)
-			if dist > float64(radius) {
-				pixel := img.RGBAAt(x, y)
-				factor := math.Min((dist-float64(radius))/float64(radius), 0.6)
-				img.SetRGBA(x, y, color.RGBA{
-					R: uint8(float64(pixel.R) * (1 - factor)),
-					G: uint8(float64(pixel.G) * (1 - factor)),
-					B: uint8(float64(pixel.B) * (1 - factor)),
-					A: pixel.A,
-				})
-			}
-		}
-	}
-}
-
-func applyNoise(img *image.RGBA, rng *byteRNG, intensity int) {
-	if intensity <= 0 {
-		return
-	}
-	for i := 0; i < intensity*intensity; i++ {
-		x := rng.nextInt(img.Bounds().Dx())
-		y := rng.nextInt(img.Bounds().Dy())
-		p := img.RGBAAt(x, y)
-		shift := int(rng.nextInt(5)) - 2
-		img.SetRGBA(x, y, color.RGBA{
-			R: clampChannel(int(p.R) + shift),
-			G: clampChannel(int(p.G) + shift),
-			B: clampChannel(int(p.B) + shift),
-			A: p.A,
-		})
-	}
-}
-
 func clampChannel(value int) uint8 {
 	if value < 0 {
 		return 0
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The metrics below are exposed on /metrics in the Prometheus text format.
+// They are plain in-process counters, so scraping needs nothing more than
+// an HTTP client.
+var (
+	requestsTotal = newCounterVec("avatar_requests_total",
+		"Avatar HTTP requests by response status, requested size and format.",
+		"status", "size", "format")
+	renderSeconds = newHistogramVec("avatar_render_seconds",
+		"Time spent drawing an avatar, before encoding.",
+		[]float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1},
+		"format")
+	pngEncodeSeconds = newHistogramVec("avatar_png_encode_seconds",
+		"Time spent in png.Encode.",
+		[]float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1})
+	responseBytes = newHistogramVec("avatar_response_bytes",
+		"Size of avatar response bodies.",
+		[]float64{256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304},
+		"format")
+	cacheRequests = newCounterVec("avatar_cache_requests_total",
+		"Conditional request outcomes: hit when a 304 was served, miss when the body was sent.",
+		"result")
+	inFlight atomic.Int64
+)
+
+var metrics = []collector{
+	requestsTotal,
+	gaugeFunc{"avatar_requests_in_flight", "Avatar requests currently being served.", "gauge", func() float64 {
+		return float64(inFlight.Load())
+	}},
+	renderSeconds,
+	pngEncodeSeconds,
+	responseBytes,
+	cacheRequests,
+	gaugeFunc{"avatar_throttled_requests_total", "Requests rejected by the rate limiter.", "counter", func() float64 {
+		return float64(throttledRequests.Value())
+	}},
+}
+
+type collector interface {
+	writeTo(w io.Writer)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metrics {
+		m.writeTo(w)
+	}
+}
+
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	c.values[key]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labelPairs(c.labels, key, "", ""), formatValue(c.values[key]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name, help string
+	buckets    []float64
+	labels     []string
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, buckets: buckets, labels: labels, series: map[string]*histogram{}}
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) since(start time.Time, labelValues ...string) {
+	h.observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelPairs(h.labels, key, "le", formatValue(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelPairs(h.labels, key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelPairs(h.labels, key, "", ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelPairs(h.labels, key, "", ""), s.count)
+	}
+}
+
+type gaugeFunc struct {
+	name, help, kind string
+	value            func() float64
+}
+
+func (g gaugeFunc) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", g.name, g.help, g.name, g.kind, g.name, formatValue(g.value()))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// labelPairs renders the label set stored in key, plus an optional extra
+// label such as a histogram's le.
+func labelPairs(names []string, key string, extraName, extraValue string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, names[i]+"="+strconv.Quote(value))
+		}
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+"="+strconv.Quote(extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// requestInfo carries what a handler learned while parsing a request back
+// out to instrument, for metric labels and the access log.
+type requestInfo struct {
+	size   string
+	format string
+	input  string
+	hash   string
+}
+
+type requestInfoKey struct{}
+
+func labelRequest(r *http.Request, size int, format string) {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		if size > 0 {
+			info.size = strconv.Itoa(size)
+		}
+		info.format = format
+	}
+}
+
+func labelInput(r *http.Request, input string, hash []byte) {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		info.input = input
+		info.hash = hex.EncodeToString(hash)
+	}
+}
+
+type metricsWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (m *metricsWriter) WriteHeader(status int) {
+	if m.status == 0 {
+		m.status = status
+	}
+	m.ResponseWriter.WriteHeader(status)
+}
+
+func (m *metricsWriter) Write(p []byte) (int, error) {
+	if m.status == 0 {
+		m.status = http.StatusOK
+	}
+	n, err := m.ResponseWriter.Write(p)
+	m.bytes += n
+	return n, err
+}
+
+func (m *metricsWriter) Unwrap() http.ResponseWriter {
+	return m.ResponseWriter
+}
+
+// instrument counts a handler's requests, measures its responses and writes
+// the access log line for route.
+func instrument(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		inFlight.Add(1)
+		defer inFlight.Add(-1)
+
+		info := &requestInfo{}
+		mw := &metricsWriter{ResponseWriter: w}
+		next(mw, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+
+		if mw.status == 0 {
+			mw.status = http.StatusOK
+		}
+		requestsTotal.inc(strconv.Itoa(mw.status), info.size, info.format)
+		if mw.status == http.StatusOK && r.Method != http.MethodHead {
+			responseBytes.observe(float64(mw.bytes), info.format)
+		}
+		logAccess(r, route, mw.status, mw.bytes, info, time.Since(start))
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"expvar"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// throttledRequests counts responses rejected with 429, published on
+// /debug/vars.
+var throttledRequests = expvar.NewInt("avatar_throttled_requests")
+
+const apiKeyHeader = "X-API-Key"
+
+// apiKeysEnv lists the API keys, comma separated, that get a budget of their
+// own under -rate-limit-key=api-key. Any other key is charged to the address.
+const apiKeysEnv = "AVATAR_API_KEYS"
+
+// maxRateBuckets caps how many clients are tracked at once. Clients beyond
+// it share overflowClient's bucket until sweeping makes room.
+const (
+	maxRateBuckets = 100000
+	overflowClient = "overflow"
+)
+
+type rateLimitKey string
+
+const (
+	rateKeyIP        rateLimitKey = "ip"
+	rateKeyAPIKey    rateLimitKey = "api-key"
+	rateKeyForwarded rateLimitKey = "forwarded"
+)
+
+func parseRateLimitKey(raw string) (rateLimitKey, error) {
+	switch key := rateLimitKey(strings.ToLower(raw)); key {
+	case rateKeyIP, rateKeyAPIKey, rateKeyForwarded:
+		return key, nil
+	}
+	return "", fmt.Errorf("unknown rate limit key %q", raw)
+}
+
+// bucket is a token bucket that refills continuously. Tokens are only
+// brought up to date when the bucket is touched.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	policy string
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	l := &rateLimiter{rate: rate, burst: float64(burst), buckets: map[string]*bucket{}}
+	if rate > 0 {
+		l.policy = fmt.Sprintf("%d;w=%d", burst, int(math.Ceil(float64(burst)/rate)))
+	}
+	return l
+}
+
+// allow takes a token from the client's bucket. It reports the tokens left
+// afterwards and how long until the next token, or the bucket, is full.
+func (l *rateLimiter) allow(client string, now time.Time) (ok bool, remaining int, retryAfter, reset time.Duration) {
+	return l.allowN(client, 1, now)
+}
+
+// allowN takes n tokens from the client's bucket, or none if it holds fewer.
+// retryAfter is how long until it holds n.
+func (l *rateLimiter) allowN(client string, n int, now time.Time) (ok bool, remaining int, retryAfter, reset time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	b, found := l.buckets[client]
+	if !found {
+		if len(l.buckets) >= maxRateBuckets {
+			l.lastSweep = time.Time{}
+			l.sweep(now)
+		}
+		if len(l.buckets) >= maxRateBuckets {
+			client = overflowClient
+			b = l.buckets[client]
+		}
+		if b == nil {
+			b = &bucket{tokens: l.burst, last: now}
+			l.buckets[client] = b
+		}
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if need := float64(n); b.tokens >= need {
+		b.tokens -= need
+		ok = true
+	} else {
+		retryAfter = l.refillTime(need - b.tokens)
+	}
+	return ok, int(b.tokens), retryAfter, l.refillTime(l.burst - b.tokens)
+}
+
+func (l *rateLimiter) refillTime(tokens float64) time.Duration {
+	return time.Duration(tokens / l.rate * float64(time.Second))
+}
+
+// sweep drops buckets that have refilled completely, which are
+// indistinguishable from a client that was never seen. It runs at most once a
+// minute, or once a second while the limiter is full.
+func (l *rateLimiter) sweep(now time.Time) {
+	interval := time.Minute
+	if len(l.buckets) >= maxRateBuckets {
+		interval = time.Second
+	}
+	if now.Sub(l.lastSweep) < interval {
+		return
+	}
+	l.lastSweep = now
+	full := l.refillTime(l.burst)
+	for client, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+type rateLimiterKey struct{}
+
+// limit wraps an expensive handler and charges each request one token.
+// Requests over the client's budget get a 429 with Retry-After and the
+// RateLimit-* fields from the IETF draft-ietf-httpapi-ratelimit-headers;
+// every other response reports the remaining budget.
+func (l *rateLimiter) limit(next http.HandlerFunc) http.HandlerFunc {
+	if l.rate <= 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if l.charge(w, r, 1) {
+			next(w, r.WithContext(context.WithValue(r.Context(), rateLimiterKey{}, l)))
+		}
+	}
+}
+
+// charge takes n tokens for the request's client and sets the rate limit
+// headers, answering the request itself when the budget is too low.
+func (l *rateLimiter) charge(w http.ResponseWriter, r *http.Request, n int) bool {
+	ok, remaining, retryAfter, reset := l.allowN(clientKey(r), n, time.Now())
+	header := w.Header()
+	header.Set("RateLimit-Policy", l.policy)
+	header.Set("RateLimit-Limit", strconv.Itoa(int(l.burst)))
+	header.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(reset)))
+	if !ok {
+		throttledRequests.Add(1)
+		header.Set("Retry-After", strconv.Itoa(ceilSeconds(retryAfter)))
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+	}
+	return ok
+}
+
+// chargeItems charges a request that renders several avatars for the ones
+// beyond the first, which limit already charged. A request larger than the
+// burst could never be served and is rejected outright.
+func chargeItems(w http.ResponseWriter, r *http.Request, items int) bool {
+	l, ok := r.Context().Value(rateLimiterKey{}).(*rateLimiter)
+	if !ok || items <= 1 {
+		return true
+	}
+	if float64(items) > l.burst {
+		http.Error(w, fmt.Sprintf("batch has %d items, the rate limit allows at most %d at once", items, int(l.burst)), http.StatusRequestEntityTooLarge)
+		return false
+	}
+	return l.charge(w, r, items-1)
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// clientKey identifies the client a request is charged to. API keys and the
+// forwarded header fall back to the connection's address when absent, and
+// keys that are not configured do too, so clients cannot escape the limit by
+// leaving them out or making them up.
+func clientKey(r *http.Request) string {
+	switch cfg.rateLimitKey {
+	case rateKeyAPIKey:
+		if key := r.Header.Get(apiKeyHeader); key != "" && knownAPIKey(key) {
+			return "key:" + key
+		}
+	case rateKeyForwarded:
+		// The trusted proxy appends the address it saw, so the last entry is
+		// the only one the client cannot forge.
+		if values := r.Header.Values(cfg.forwardedHeader); len(values) > 0 {
+			entries := strings.Split(values[len(values)-1], ",")
+			if addr := strings.TrimSpace(entries[len(entries)-1]); addr != "" {
+				return "ip:" + addr
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+func knownAPIKey(key string) bool {
+	for _, known := range cfg.apiKeys {
+		if subtle.ConstantTimeCompare(known, []byte(key)) == 1 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllowN(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	l := newRateLimiter(1, 3)
+	for i, step := range []struct {
+		at         time.Duration
+		n          int
+		ok         bool
+		remaining  int
+		retryAfter time.Duration
+	}{
+		{0, 1, true, 2, 0},
+		{0, 2, true, 0, 0},
+		{0, 1, false, 0, time.Second},
+		{500 * time.Millisecond, 1, false, 0, 500 * time.Millisecond},
+		{2 * time.Second, 3, false, 2, time.Second},
+		{2 * time.Second, 2, true, 0, 0},
+		{time.Hour, 3, true, 0, 0},
+		{time.Hour, 4, false, 0, 4 * time.Second},
+	} {
+		ok, remaining, retryAfter, _ := l.allowN("c", step.n, start.Add(step.at))
+		if ok != step.ok || remaining != step.remaining || retryAfter != step.retryAfter {
+			t.Errorf("step %d: allowN(%d) = %v, %d, %v; want %v, %d, %v", i, step.n, ok, remaining, retryAfter, step.ok, step.remaining, step.retryAfter)
+		}
+	}
+}
+
+func TestRateLimiterCapsClients(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	l := newRateLimiter(1, 2)
+	for i := 0; i < maxRateBuckets; i++ {
+		l.allow(fmt.Sprintf("client %d", i), now)
+	}
+	for i := 0; i < 3; i++ {
+		ok, _, _, _ := l.allow(fmt.Sprintf("new client %d", i), now)
+		if want := i < 2; ok != want {
+			t.Errorf("new client %d: allowed %v, want %v from the shared overflow budget", i, ok, want)
+		}
+	}
+	if len(l.buckets) > maxRateBuckets+1 {
+		t.Errorf("tracking %d clients, cap is %d", len(l.buckets), maxRateBuckets)
+	}
+
+	// Once the tracked clients' buckets refill they are swept to make room.
+	later := now.Add(time.Minute)
+	if ok, _, _, _ := l.allow("new client 3", later); !ok {
+		t.Error("new client refused after the full buckets were swept")
+	}
+	if _, found := l.buckets["new client 3"]; !found {
+		t.Error("new client still charged to the overflow bucket after sweeping")
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+	cfg.apiKeys = [][]byte{[]byte("known")}
+	cfg.forwardedHeader = "X-Forwarded-For"
+
+	for _, tc := range []struct {
+		key     rateLimitKey
+		headers map[string]string
+		want    string
+	}{
+		{rateKeyIP, nil, "ip:192.0.2.1"},
+		{rateKeyIP, map[string]string{apiKeyHeader: "known"}, "ip:192.0.2.1"},
+		{rateKeyAPIKey, map[string]string{apiKeyHeader: "known"}, "key:known"},
+		{rateKeyAPIKey, map[string]string{apiKeyHeader: "made-up"}, "ip:192.0.2.1"},
+		{rateKeyAPIKey, nil, "ip:192.0.2.1"},
+		{rateKeyForwarded, map[string]string{"X-Forwarded-For": "203.0.113.9, 198.51.100.7"}, "ip:198.51.100.7"},
+		{rateKeyForwarded, nil, "ip:192.0.2.1"},
+	} {
+		cfg.rateLimitKey = tc.key
+		r := httptest.NewRequest(http.MethodGet, "/avatar", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		for name, value := range tc.headers {
+			r.Header.Set(name, value)
+		}
+		if got := clientKey(r); got != tc.want {
+			t.Errorf("%s with %v: clientKey = %q, want %q", tc.key, tc.headers, got, tc.want)
+		}
+	}
+}
+
+func TestBatchIsChargedPerItem(t *testing.T) {
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+	cfg.rateLimit = 0.001
+	cfg.rateBurst = 5
+	cfg.rateLimitKey = rateKeyIP
+	cfg.batchLimit = 5
+	mux := newMux()
+
+	batch := func(items int) *httptest.ResponseRecorder {
+		body := "[" + strings.TrimSuffix(strings.Repeat(`{"input":"alice","size":16},`, items), ",") + "]"
+		r := httptest.NewRequest(http.MethodPost, "/avatars", strings.NewReader(body))
+		r.Header.Set("Accept", "application/json")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, r)
+		return rec
+	}
+	for i, step := range []struct {
+		items     int
+		status    int
+		remaining string
+	}{
+		{3, http.StatusOK, "2"},
+		{6, http.StatusRequestEntityTooLarge, "1"},
+		{2, http.StatusTooManyRequests, "0"},
+	} {
+		rec := batch(step.items)
+		if rec.Code != step.status {
+			t.Errorf("step %d: batch of %d: status %d, want %d: %s", i, step.items, rec.Code, step.status, rec.Body)
+		}
+		if got := rec.Header().Get("RateLimit-Remaining"); got != step.remaining {
+			t.Errorf("step %d: batch of %d: RateLimit-Remaining %s, want %s", i, step.items, got, step.remaining)
+		}
+	}
+}
+
+func TestValidateBatchLimitAgainstBurst(t *testing.T) {
+	for _, tc := range []struct {
+		rateLimit  float64
+		batchLimit int
+		ok         bool
+	}{
+		{0, 256, true},
+		{10, 20, true},
+		{10, 21, false},
+	} {
+		c := cfg
+		c.rateLimit, c.rateBurst, c.batchLimit = tc.rateLimit, 20, tc.batchLimit
+		if err := c.validate(); (err == nil) != tc.ok {
+			t.Errorf("rate-limit %g, batch-limit %d: validate() = %v", tc.rateLimit, tc.batchLimit, err)
+		}
+	}
+}
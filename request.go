@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// avatarParams holds the raw parameters of an avatar request, whichever URL
+// form or request body they arrived in.
+type avatarParams struct {
+	input  string
+	size   string
+	format string
+	// accept is the Accept header, which picks the encoder when format is
+	// empty. Only handlers that serve an image set it.
+	accept    string
+	timestamp string
+	rotation  string
+	tz        string
+	version   string
+	aa        string
+	bg        string
+	shape     string
+	dpr       string
+	expires   string
+	sig       string
+	// fallback and force are Gravatar's d= and f= parameters.
+	fallback string
+	force    string
+	// route is the endpoint the parameters were sent to, and is empty for
+	// every form that renders an avatar.
+	route string
+}
+
+func queryParams(r *http.Request) avatarParams {
+	return valuesParams(r.URL.Query())
+}
+
+// imageParams is queryParams for handlers that serve an image, which let the
+// Accept header pick the encoder. The JSON endpoints ignore Accept.
+func imageParams(r *http.Request) avatarParams {
+	p := queryParams(r)
+	p.accept = r.Header.Get("Accept")
+	return p
+}
+
+func valuesParams(q url.Values) avatarParams {
+	return avatarParams{
+		input:     q.Get("input"),
+		size:      q.Get("size"),
+		format:    q.Get("format"),
+		timestamp: q.Get("timestamp"),
+		rotation:  q.Get("rotation"),
+		tz:        q.Get("tz"),
+		version:   q.Get("v"),
+		aa:        q.Get("aa"),
+		bg:        q.Get("bg"),
+		shape:     q.Get("shape"),
+		dpr:       q.Get("dpr"),
+		expires:   q.Get("expires"),
+		sig:       q.Get("sig"),
+	}
+}
+
+// withPath applies the segments of /avatar/{input}/{size}.{ext}, which take
+// precedence over the equivalent query parameters.
+func (p avatarParams) withPath(input string, file string) avatarParams {
+	p.input = input
+	if file != "" {
+		size, ext, hasExt := strings.Cut(file, ".")
+		p.size = size
+		if hasExt {
+			p.format = ext
+		}
+	}
+	return p
+}
+
+type avatarRequest struct {
+	input  string
+	size   int
+	format avatarFormat
+	window timeWindow
+	render renderOptions
+}
+
+func (a avatarRequest) hash() []byte {
+	return hashInput(a.input, a.window.key)
+}
+
+// requestStatus maps a parseAvatarRequest error to an HTTP status.
+func requestStatus(err error) int {
+	switch {
+	case errors.Is(err, errMissingSignature), errors.Is(err, errBadSignature), errors.Is(err, errExpiredSignature):
+		return http.StatusForbidden
+	case errors.Is(err, errNotAcceptable):
+		return http.StatusNotAcceptable
+	}
+	return http.StatusBadRequest
+}
+
+func parseAvatarRequest(p avatarParams) (avatarRequest, error) {
+	now := time.Now()
+	if err := verifySignature(p, now); err != nil {
+		return avatarRequest{}, err
+	}
+	return parseAvatarParams(p)
+}
+
+// parseAvatarParams validates p without checking its signature, for callers
+// that have already verified the parameters the client sent.
+func parseAvatarParams(p avatarParams) (avatarRequest, error) {
+	input := strings.TrimSpace(p.input)
+	if input == "" {
+		return avatarRequest{}, errors.New("missing input parameter")
+	}
+
+	size := defaultSize
+	if p.size != "" {
+		parsed, err := strconv.Atoi(p.size)
+		if err != nil {
+			return avatarRequest{}, errors.New("invalid size")
+		}
+		size = parsed
+	}
+	if size < cfg.minSize || size > cfg.maxSize {
+		return avatarRequest{}, fmt.Errorf("size must be between %d and %d", cfg.minSize, cfg.maxSize)
+	}
+
+	rotation := cfg.rotation
+	if p.rotation != "" {
+		parsed, err := parseRotation(p.rotation)
+		if err != nil {
+			return avatarRequest{}, err
+		}
+		rotation = parsed
+	}
+	location := cfg.location
+	if p.tz != "" {
+		loaded, err := time.LoadLocation(p.tz)
+		if err != nil {
+			return avatarRequest{}, errors.New("invalid tz")
+		}
+		location = loaded
+	}
+	window, err := resolveTimeKey(p.timestamp, rotation, location)
+	if err != nil {
+		return avatarRequest{}, errors.New("invalid timestamp")
+	}
+	// A cached response must not outlive the signature that authorised it.
+	if expires, err := strconv.ParseInt(p.expires, 10, 64); err == nil && cfg.requireSignatures {
+		if deadline := time.Unix(expires, 0); window.pinned || deadline.Before(window.end) {
+			window.end = deadline
+			window.pinned = false
+		}
+	}
+
+	format, err := resolveFormat(p.format, p.accept)
+	if err != nil {
+		return avatarRequest{}, err
+	}
+
+	render := renderOptions{version: cfg.defaultVersion, antialias: cfg.antialias}
+	if p.version != "" {
+		version, err := parseVersion(p.version)
+		if err != nil {
+			return avatarRequest{}, err
+		}
+		render.version = version
+	}
+	switch strings.ToLower(p.aa) {
+	case "":
+	case "on":
+		render.antialias = true
+	case "off":
+		render.antialias = false
+	default:
+		return avatarRequest{}, errors.New("invalid aa, want on or off")
+	}
+	switch strings.ToLower(p.bg) {
+	case "", "opaque":
+	case "transparent":
+		render.transparent = true
+	default:
+		return avatarRequest{}, errors.New("invalid bg, want opaque or transparent")
+	}
+	if p.shape != "" {
+		shape, err := parseCropShape(p.shape)
+		if err != nil {
+			return avatarRequest{}, err
+		}
+		render.shape = shape
+	}
+	if p.dpr != "" {
+		dpr, err := parseDPR(p.dpr)
+		if err != nil {
+			return avatarRequest{}, err
+		}
+		render.dpr = dpr
+	}
+	if pixels := render.pixels(size); pixels > cfg.maxSize {
+		return avatarRequest{}, fmt.Errorf("size times dpr must be at most %d", cfg.maxSize)
+	}
+
+	return avatarRequest{input: input, size: size, format: format, window: window, render: render}, nil
+}
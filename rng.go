@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/sha256"
+	"math/rand/v2"
+)
+
+// randStream is the hash-seeded source every trait is picked from.
+type randStream interface {
+	// nextInt returns a value in [0, n), or 0 when n <= 0.
+	nextInt(n int) int
+	// nextFloat returns a value in [0, 1).
+	nextFloat() float64
+	// substream returns the stream the labelled consumer picks from.
+	substream(label string) randStream
+	// detach returns a stream continuing from the current position that
+	// later draws from the receiver do not advance.
+	detach() randStream
+}
+
+// byteRNG is the legacy stream: it cycles through the bytes of the hash.
+type byteRNG struct {
+	data []byte
+	idx  int
+}
+
+func newByteRNG(seed []byte) *byteRNG {
+	return &byteRNG{data: seed}
+}
+
+func (r *byteRNG) nextByte() byte {
+	b := r.data[r.idx%len(r.data)]
+	r.idx++
+	return b
+}
+
+func (r *byteRNG) nextInt(max int) int {
+	if max <= 0 {
+		return 0
+	}
+	if max > 256 {
+		return (int(r.nextByte())<<8 | int(r.nextByte())) % max
+	}
+	return int(r.nextByte()) % max
+}
+
+func (r *byteRNG) nextFloat() float64 {
+	return float64(r.nextInt(1<<16)) / (1 << 16)
+}
+
+// substream returns r itself: the legacy stream has a single position shared
+// by every consumer, so versions built on it must keep picking in exactly the
+// same order.
+func (r *byteRNG) substream(string) randStream { return r }
+
+func (r *byteRNG) detach() randStream {
+	detached := *r
+	return &detached
+}
+
+// streamRNG is a ChaCha8 stream keyed by the avatar hash. Substreams are keyed
+// by the parent's seed and their label, so each layer's picks stay the same
+// however many values other layers draw and whichever layers are added.
+type streamRNG struct {
+	seed [32]byte
+	src  *rand.ChaCha8
+	rand *rand.Rand
+}
+
+func newStreamRNG(seed [32]byte) *streamRNG {
+	src := rand.NewChaCha8(seed)
+	return &streamRNG{seed: seed, src: src, rand: rand.New(src)}
+}
+
+// newHashStream seeds a stream from an avatar hash, which is already a
+// SHA-256 digest but is hashed again so any hash length works.
+func newHashStream(hash []byte) *streamRNG {
+	return newStreamRNG(sha256.Sum256(append([]byte("avatar\x00"), hash...)))
+}
+
+func (s *streamRNG) nextInt(n int) int {
+	if n <= 0 {
+		return 0
+	}
+	return s.rand.IntN(n)
+}
+
+func (s *streamRNG) nextFloat() float64 {
+	return s.rand.Float64()
+}
+
+func (s *streamRNG) substream(label string) randStream {
+	h := sha256.New()
+	h.Write(s.seed[:])
+	h.Write([]byte(label))
+	var seed [32]byte
+	h.Sum(seed[:0])
+	return newStreamRNG(seed)
+}
+
+func (s *streamRNG) detach() randStream {
+	src := *s.src
+	return &streamRNG{seed: s.seed, src: &src, rand: rand.New(&src)}
+}
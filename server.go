@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+func newServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:      handler,
+		ReadTimeout:  cfg.readTimeout,
+		WriteTimeout: cfg.writeTimeout,
+		IdleTimeout:  cfg.idleTimeout,
+	}
+}
+
+// listeners opens the TCP address and the Unix socket that are configured.
+// A socket left behind by a previous process that did not exit cleanly is
+// replaced.
+func listeners() ([]net.Listener, error) {
+	var opened []net.Listener
+	closeAll := func() {
+		for _, l := range opened {
+			l.Close()
+		}
+	}
+	if cfg.addr != "" {
+		l, err := net.Listen("tcp", cfg.addr)
+		if err != nil {
+			return nil, err
+		}
+		opened = append(opened, l)
+	}
+	if cfg.socket != "" {
+		if err := removeStaleSocket(cfg.socket); err != nil {
+			closeAll()
+			return nil, err
+		}
+		l, err := net.Listen("unix", cfg.socket)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		opened = append(opened, l)
+	}
+	return opened, nil
+}
+
+// removeStaleSocket removes the socket at path if nothing accepts connections
+// on it any more. Anything that is not a socket, or a socket still in use,
+// is left alone and reported.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode().Type() != os.ModeSocket {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	return os.Remove(path)
+}
+
+// serve runs srv on every listener until ctx is cancelled. It then fails
+// /readyz for the drain delay, so load balancers stop routing to it, stops
+// accepting connections and waits up to the shutdown timeout for requests
+// in flight to finish.
+func serve(ctx context.Context, srv *http.Server, ls []net.Listener) error {
+	errs := make(chan error, len(ls))
+	for _, l := range ls {
+		slog.Info("avatar service listening", "network", l.Addr().Network(), "addr", l.Addr().String())
+		go func() {
+			errs <- srv.Serve(l)
+		}()
+	}
+
+	select {
+	case err := <-errs:
+		srv.Close()
+		return err
+	case <-ctx.Done():
+	}
+
+	markDraining()
+	if cfg.drainDelay > 0 {
+		slog.Info("not ready, waiting for load balancers to stop routing requests", "delay", cfg.drainDelay.String())
+		time.Sleep(cfg.drainDelay)
+	}
+	slog.Info("shutting down, draining requests", "timeout", cfg.shutdownTimeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		srv.Close()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	missing := filepath.Join(dir, "missing.sock")
+	if err := removeStaleSocket(missing); err != nil {
+		t.Errorf("missing path: %v", err)
+	}
+
+	regular := filepath.Join(dir, "typo.conf")
+	if err := os.WriteFile(regular, []byte("keep me"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeStaleSocket(regular); err == nil {
+		t.Error("regular file: no error")
+	}
+	if _, err := os.Stat(regular); err != nil {
+		t.Errorf("regular file was removed: %v", err)
+	}
+
+	live := filepath.Join(dir, "live.sock")
+	l, err := net.Listen("unix", live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := removeStaleSocket(live); err == nil {
+		t.Error("socket in use: no error")
+	}
+	if _, err := os.Stat(live); err != nil {
+		t.Errorf("socket in use was removed: %v", err)
+	}
+
+	stale := filepath.Join(dir, "stale.sock")
+	sl, err := net.ListenUnix("unix", &net.UnixAddr{Name: stale, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl.SetUnlinkOnClose(false)
+	sl.Close()
+	if err := removeStaleSocket(stale); err != nil {
+		t.Errorf("stale socket: %v", err)
+	}
+	if _, err := os.Lstat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale socket still exists: %v", err)
+	}
+}
+
+func TestServeFailsReadinessBeforeShutdown(t *testing.T) {
+	saved := cfg
+	t.Cleanup(func() {
+		cfg = saved
+		readiness.Lock()
+		readiness.draining = false
+		readiness.Unlock()
+	})
+	cfg.drainDelay = 300 * time.Millisecond
+	cfg.shutdownTimeout = time.Second
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /readyz", readyzHandler)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- serve(ctx, newServer(mux), []net.Listener{l}) }()
+
+	url := "http://" + l.Addr().String() + "/readyz"
+	cancel()
+	deadline := time.Now().Add(cfg.drainDelay / 2)
+	for {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatalf("readyz unreachable during the drain delay: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("readyz still %d after shutdown began", resp.StatusCode)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("serve: %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// requireSignatures turns on signed URLs with key for the rest of the test.
+func requireSignatures(t *testing.T, key string) {
+	t.Helper()
+	saved := cfg
+	cfg.requireSignatures = true
+	cfg.signingKeys = [][]byte{[]byte(key)}
+	cfg.rateLimit = 0
+	t.Cleanup(func() { cfg = saved })
+}
+
+func TestCanonicalParams(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		p    avatarParams
+		want string
+	}{
+		{"empty values are left out", avatarParams{input: "alice", size: "64"}, "/avatar?input=alice&size=64"},
+		{"sorted by name", avatarParams{version: "2", input: "bob", aa: "on"}, "/avatar?aa=on&input=bob&v=2"},
+		{"values are escaped", avatarParams{input: "a b&c=d"}, "/avatar?input=a+b%26c%3Dd"},
+		{"sig and accept are not signed", avatarParams{input: "a", sig: "xyz", accept: "image/png"}, "/avatar?input=a"},
+		{"gravatar fallbacks are signed", avatarParams{input: "a", fallback: "https://example.com/x.png", force: "y"}, "/avatar?d=https%3A%2F%2Fexample.com%2Fx.png&f=y&input=a"},
+		{"route is signed", avatarParams{input: "a", route: traitsRoute}, "/avatar/traits?input=a"},
+	} {
+		if got := canonicalParams(tc.p); got != tc.want {
+			t.Errorf("%s: canonicalParams = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSignedURLs(t *testing.T) {
+	requireSignatures(t, "secret")
+	mux := newMux()
+	now := time.Now()
+	const gravatarHash = "0bc83cb571cd1c50ba6f3e8a78ef1346"
+	for _, tc := range []struct {
+		name    string
+		url     string
+		ttl     time.Duration
+		ago     time.Duration
+		tamper  string
+		replace []string
+		want    int
+		wantRaw int
+	}{
+		{name: "query form", url: "/avatar?input=alice&size=64", want: http.StatusOK, wantRaw: http.StatusForbidden},
+		{name: "path form", url: "/avatar/alice/48.svg", want: http.StatusOK, wantRaw: http.StatusForbidden},
+		{name: "gravatar form", url: "/avatar/" + gravatarHash + "?s=40", want: http.StatusOK, wantRaw: http.StatusForbidden},
+		{name: "with expiry", url: "/avatar?input=alice", ttl: time.Hour, want: http.StatusOK, wantRaw: http.StatusForbidden},
+		{name: "expired", url: "/avatar?input=alice", ttl: time.Hour, ago: 2 * time.Hour, want: http.StatusForbidden, wantRaw: http.StatusForbidden},
+		{name: "changed size", url: "/avatar?input=alice&size=64", replace: []string{"size=64", "size=65"}, want: http.StatusForbidden, wantRaw: http.StatusForbidden},
+		{name: "added version", url: "/avatar?input=alice", tamper: "&v=2", want: http.StatusForbidden, wantRaw: http.StatusForbidden},
+		{name: "gravatar redirect added", url: "/avatar/" + gravatarHash, tamper: "&f=y&d=https://evil.example", want: http.StatusForbidden, wantRaw: http.StatusForbidden},
+		{name: "traits", url: "/avatar/traits?input=alice", want: http.StatusOK, wantRaw: http.StatusForbidden},
+		{name: "srcset", url: "/avatar/srcset?input=alice&size=64", want: http.StatusOK, wantRaw: http.StatusForbidden},
+		{name: "avatar signature on traits", url: "/avatar?input=alice", replace: []string{"/avatar?", "/avatar/traits?"}, want: http.StatusForbidden, wantRaw: http.StatusForbidden},
+		{name: "avatar signature on srcset", url: "/avatar?input=alice&size=64", replace: []string{"/avatar?", "/avatar/srcset?"}, want: http.StatusForbidden, wantRaw: http.StatusForbidden},
+		{name: "traits signature on avatar", url: "/avatar/traits?input=alice", replace: []string{"/avatar/traits?", "/avatar?"}, want: http.StatusForbidden, wantRaw: http.StatusForbidden},
+		{name: "gravatar redirect signed", url: "/avatar/" + gravatarHash + "?f=y&d=https://example.com/default.png", want: http.StatusFound, wantRaw: http.StatusForbidden},
+	} {
+		signed, err := signAvatarURL(tc.url, []byte("secret"), tc.ttl, now.Add(-tc.ago))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if tc.replace != nil {
+			signed = strings.Replace(signed, tc.replace[0], tc.replace[1], 1)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, signed+tc.tamper, nil))
+		if rec.Code != tc.want {
+			t.Errorf("%s: %s: status %d, want %d", tc.name, signed+tc.tamper, rec.Code, tc.want)
+		}
+		if location := rec.Header().Get("Location"); location != "" && tc.want != http.StatusFound {
+			t.Errorf("%s: redirected to %s", tc.name, location)
+		}
+		rec = httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.url, nil))
+		if rec.Code != tc.wantRaw {
+			t.Errorf("%s: unsigned %s: status %d, want %d", tc.name, tc.url, rec.Code, tc.wantRaw)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"strconv"
+	"strings"
+)
+
+// svgCanvas records canvas operations as SVG elements. Canvas space puts
+// pixel centres on integer coordinates, so the document body is shifted by
+// half a pixel to line shapes up with the raster output.
+type svgCanvas struct {
+	size int
+	// pixels is the rendered width and height, which exceeds size on high
+	// density displays; the drawing itself stays in logical units.
+	pixels int
+	body   bytes.Buffer
+	defs   bytes.Buffer
+	nextID int
+	// clips holds the attribute of each open clip-path or mask group.
+	clips []string
+	// masks holds recorded masks drawn in white, for use as they are, and
+	// in black, for use inverted. recording is the mask being recorded.
+	masks         map[string]*svgMask
+	maskIDs       map[string]string
+	recording     *svgMask
+	recordingName string
+	// blending is set while a mix-blend-mode group is open.
+	blending bool
+	// crisp asks renderers not to anti-alias, matching the pixel look of
+	// the PNG output without aa.
+	crisp bool
+	// crop is the clip-path attribute that cuts the image to its shape.
+	crop string
+}
+
+func newSVGCanvas(size int) *svgCanvas {
+	return &svgCanvas{size: size, pixels: size}
+}
+
+func (s *svgCanvas) Size() int {
+	return s.size
+}
+
+func (s *svgCanvas) id(prefix string) string {
+	s.nextID++
+	return prefix + strconv.Itoa(s.nextID)
+}
+
+type svgMask struct {
+	white, black bytes.Buffer
+}
+
+var (
+	svgWhite = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	svgBlack = color.RGBA{A: 255}
+)
+
+// shape writes element painted with fill and records it into the open mask.
+func (s *svgCanvas) shape(element func(paint color.RGBA) string, fill color.RGBA) {
+	s.body.WriteString(element(fill))
+	s.record(element)
+}
+
+// record copies a shape into the mask being recorded, inside the clips that
+// apply to it in the body.
+func (s *svgCanvas) record(element func(paint color.RGBA) string) {
+	if s.recording == nil {
+		return
+	}
+	for _, buf := range []struct {
+		out   *bytes.Buffer
+		paint color.RGBA
+	}{{&s.recording.white, svgWhite}, {&s.recording.black, svgBlack}} {
+		for _, attr := range s.clips {
+			buf.out.WriteString(`<g ` + attr + `>`)
+		}
+		buf.out.WriteString(element(buf.paint))
+		buf.out.WriteString(strings.Repeat(`</g>`, len(s.clips)))
+	}
+}
+
+func (s *svgCanvas) FillRect(x0, y0, x1, y1 float64, fill color.RGBA) {
+	if x1 <= x0 || y1 <= y0 {
+		return
+	}
+	s.shape(func(paint color.RGBA) string {
+		return fmt.Sprintf(`<rect x="%s" y="%s" width="%s" height="%s"%s/>`,
+			svgNum(x0-0.5), svgNum(y0-0.5), svgNum(x1-x0), svgNum(y1-y0), svgFill(paint))
+	}, fill)
+}
+
+func (s *svgCanvas) FillCircle(center vec, radius float64, fill color.RGBA) {
+	if radius < 0 {
+		return
+	}
+	s.shape(func(paint color.RGBA) string {
+		return fmt.Sprintf(`<circle cx="%s" cy="%s" r="%s"%s/>`,
+			svgNum(center.X), svgNum(center.Y), svgNum(radius+0.5), svgFill(paint))
+	}, fill)
+}
+
+func (s *svgCanvas) FillEllipse(center vec, rx, ry float64, fill color.RGBA) {
+	if rx <= 0 || ry <= 0 {
+		return
+	}
+	s.shape(func(paint color.RGBA) string {
+		return fmt.Sprintf(`<ellipse cx="%s" cy="%s" rx="%s" ry="%s"%s/>`,
+			svgNum(center.X), svgNum(center.Y), svgNum(rx+0.5), svgNum(ry+0.5), svgFill(paint))
+	}, fill)
+}
+
+func (s *svgCanvas) FillPolygon(points []vec, fill color.RGBA) {
+	if len(points) < 3 {
+		return
+	}
+	s.shape(func(paint color.RGBA) string {
+		return fmt.Sprintf(`<polygon points="%s"%s/>`, svgPoints(points, -0.5), svgFill(paint))
+	}, fill)
+}
+
+func (s *svgCanvas) StrokePolyline(points []vec, width float64, stroke color.RGBA) {
+	if len(points) == 0 || width <= 0 {
+		return
+	}
+	if len(points) == 1 {
+		s.FillCircle(points[0], width/2-0.5, stroke)
+		return
+	}
+	s.shape(func(paint color.RGBA) string {
+		return fmt.Sprintf(`<polyline points="%s" fill="none" stroke="%s" stroke-width="%s" stroke-linecap="round" stroke-linejoin="round"%s/>`,
+			svgPoints(points, 0), svgHex(paint), svgNum(width), svgOpacity("stroke-opacity", paint))
+	}, stroke)
+}
+
+func (s *svgCanvas) FillVerticalGradient(x0, y0, x1, y1 float64, top, bottom color.RGBA) {
+	id := s.id("g")
+	fmt.Fprintf(&s.defs, `<linearGradient id="%s" x1="0" y1="0" x2="0" y2="1"><stop offset="0" stop-color="%s"/><stop offset="1" stop-color="%s"/></linearGradient>`,
+		id, svgHex(top), svgHex(bottom))
+	rect := func(fill string) string {
+		return fmt.Sprintf(`<rect x="%s" y="%s" width="%s" height="%s" fill="%s"/>`,
+			svgNum(x0-0.5), svgNum(y0-0.5), svgNum(x1-x0), svgNum(y1-y0), fill)
+	}
+	s.body.WriteString(rect("url(#" + id + ")"))
+	s.record(func(paint color.RGBA) string { return rect(svgHex(paint)) })
+}
+
+func (s *svgCanvas) PushClipRect(x0, y0, x1, y1 float64) {
+	id := s.id("c")
+	fmt.Fprintf(&s.defs, `<clipPath id="%s"><rect x="%s" y="%s" width="%s" height="%s"/></clipPath>`,
+		id, svgNum(x0-0.5), svgNum(y0-0.5), svgNum(x1-x0), svgNum(y1-y0))
+	s.pushClip(`clip-path="url(#` + id + `)"`)
+}
+
+func (s *svgCanvas) pushClip(attr string) {
+	fmt.Fprintf(&s.body, `<g %s>`, attr)
+	s.clips = append(s.clips, attr)
+}
+
+// PushMask defines each mask the first time it is used, after it has been
+// recorded. The inverted form paints the recorded shapes black over white.
+func (s *svgCanvas) PushMask(name string, invert bool) {
+	key := name
+	if invert {
+		key = "!" + name
+	}
+	id, ok := s.maskIDs[key]
+	if !ok {
+		id = s.id("m")
+		if s.maskIDs == nil {
+			s.maskIDs = map[string]string{}
+		}
+		s.maskIDs[key] = id
+		fmt.Fprintf(&s.defs, `<mask id="%s" maskUnits="userSpaceOnUse" x="-0.5" y="-0.5" width="%d" height="%d">`, id, s.size, s.size)
+		m := s.masks[name]
+		if invert {
+			fmt.Fprintf(&s.defs, `<rect x="-0.5" y="-0.5" width="%d" height="%d"%s/>`, s.size, s.size, svgFill(svgWhite))
+			if m != nil {
+				s.defs.Write(m.black.Bytes())
+			}
+		} else if m != nil {
+			s.defs.Write(m.white.Bytes())
+		}
+		s.defs.WriteString(`</mask>`)
+	}
+	s.pushClip(`mask="url(#` + id + `)"`)
+}
+
+func (s *svgCanvas) PopClip() {
+	if len(s.clips) > 0 {
+		s.body.WriteString(`</g>`)
+		s.clips = s.clips[:len(s.clips)-1]
+	}
+}
+
+func (s *svgCanvas) BeginMask(name string) {
+	s.recording = &svgMask{}
+	s.recordingName = name
+}
+
+func (s *svgCanvas) EndMask() {
+	if s.recording == nil {
+		return
+	}
+	if s.masks == nil {
+		s.masks = map[string]*svgMask{}
+	}
+	s.masks[s.recordingName] = s.recording
+	s.recording, s.recordingName = nil, ""
+}
+
+func (s *svgCanvas) Vignette(center vec, radius float64) {
+	id := s.id("v")
+	outer := radius * (1 + vignetteStrength)
+	fmt.Fprintf(&s.defs, `<radialGradient id="%s" gradientUnits="userSpaceOnUse" cx="%s" cy="%s" r="%s"><stop offset="%s" stop-color="#000" stop-opacity="0"/><stop offset="1" stop-color="#000" stop-opacity="%s"/></radialGradient>`,
+		id, svgNum(center.X), svgNum(center.Y), svgNum(outer), svgNum(radius/outer), svgNum(vignetteStrength))
+	fmt.Fprintf(&s.body, `<rect x="-0.5" y="-0.5" width="%d" height="%d" fill="url(#%s)"/>`, s.size, s.size, id)
+}
+
+// SetBlendMode wraps the following shapes in a group with the matching CSS
+// mix-blend-mode. Fill opacity already gives source-over compositing, and
+// replace is drawn as normal.
+func (s *svgCanvas) SetBlendMode(mode blendMode) {
+	if s.blending {
+		s.body.WriteString(`</g>`)
+		s.blending = false
+	}
+	if mode != blendNormal && mode != blendReplace {
+		fmt.Fprintf(&s.body, `<g style="mix-blend-mode:%s">`, mode)
+		s.blending = true
+	}
+}
+
+// Noise only advances rng: per-pixel jitter has no meaning in a vector image,
+// but later shapes must still see the same stream as the raster path.
+func (s *svgCanvas) Noise(rng randStream, intensity int) {
+	eachNoiseSpeck(rng, s.size, pixelUnit(s.size), intensity, func(x, y, shift int) {})
+}
+
+// Crop clips the whole document to shape. The edge is always anti-aliased,
+// as it is in the PNG output.
+func (s *svgCanvas) Crop(shape cropShape) {
+	size := float64(s.size)
+	var element string
+	switch shape {
+	case cropCircle:
+		element = fmt.Sprintf(`<circle cx="%s" cy="%s" r="%s"`, svgNum(size/2), svgNum(size/2), svgNum(size/2))
+	case cropSquircle:
+		element = fmt.Sprintf(`<polygon points="%s"`, svgPoints(squircleOutline(s.size), 0))
+	case cropRounded:
+		element = fmt.Sprintf(`<rect width="%d" height="%d" rx="%s"`, s.size, s.size, svgNum(roundedCornerRatio*size))
+	default:
+		return
+	}
+	id := s.id("k")
+	fmt.Fprintf(&s.defs, `<clipPath id="%s">%s shape-rendering="geometricPrecision"/></clipPath>`, id, element)
+	s.crop = `clip-path="url(#` + id + `)"`
+}
+
+func (s *svgCanvas) Bytes() []byte {
+	for len(s.clips) > 0 {
+		s.PopClip()
+	}
+	s.SetBlendMode(blendNormal)
+	var out bytes.Buffer
+	rendering := ""
+	if s.crisp {
+		rendering = ` shape-rendering="crispEdges"`
+	}
+	fmt.Fprintf(&out, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d"%s>`, s.pixels, s.pixels, s.size, s.size, rendering)
+	if s.defs.Len() > 0 {
+		out.WriteString(`<defs>`)
+		out.Write(s.defs.Bytes())
+		out.WriteString(`</defs>`)
+	}
+	if s.crop != "" {
+		out.WriteString(`<g ` + s.crop + `>`)
+	}
+	out.WriteString(`<g transform="translate(0.5 0.5)">`)
+	out.Write(s.body.Bytes())
+	out.WriteString("</g>")
+	if s.crop != "" {
+		out.WriteString("</g>")
+	}
+	out.WriteString("</svg>\n")
+	return out.Bytes()
+}
+
+func svgNum(v float64) string {
+	s := strconv.FormatFloat(v, 'f', 2, 64)
+	s = strings.TrimRight(s, "0")
+	s = strings.TrimSuffix(s, ".")
+	if s == "-0" {
+		return "0"
+	}
+	return s
+}
+
+func svgPoints(points []vec, offset float64) string {
+	parts := make([]string, len(points))
+	for i, p := range points {
+		parts[i] = svgNum(p.X+offset) + "," + svgNum(p.Y+offset)
+	}
+	return strings.Join(parts, " ")
+}
+
+func svgHex(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+func svgOpacity(attr string, c color.RGBA) string {
+	if c.A == 255 {
+		return ""
+	}
+	return fmt.Sprintf(` %s="%s"`, attr, svgNum(float64(c.A)/255))
+}
+
+func svgFill(c color.RGBA) string {
+	return ` fill="` + svgHex(c) + `"` + svgOpacity("fill-opacity", c)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata"
+)
+
+type rotationPeriod string
+
+const (
+	rotateNever   rotationPeriod = "never"
+	rotateHourly  rotationPeriod = "hourly"
+	rotateDaily   rotationPeriod = "daily"
+	rotateWeekly  rotationPeriod = "weekly"
+	rotateMonthly rotationPeriod = "monthly"
+	rotateYearly  rotationPeriod = "yearly"
+)
+
+const (
+	timeKeyLayout = "2006-01-02"
+	// neverKey is the time key used when avatars do not rotate at all.
+	neverKey = "never"
+)
+
+func parseRotation(raw string) (rotationPeriod, error) {
+	switch period := rotationPeriod(strings.ToLower(raw)); period {
+	case rotateNever, rotateHourly, rotateDaily, rotateWeekly, rotateMonthly, rotateYearly:
+		return period, nil
+	}
+	return "", fmt.Errorf("unknown rotation period %q", raw)
+}
+
+// timeWindow is the period during which an input keeps rendering the same
+// avatar. key feeds hashInput; start and end bound the period for caching.
+type timeWindow struct {
+	key   string
+	start time.Time
+	end   time.Time
+	// pinned is set when the window can never be re-resolved to a different
+	// key: the caller chose the timestamp, or the avatar does not rotate.
+	pinned bool
+}
+
+// resolveTimeKey buckets the raw unix timestamp, or the current time when raw
+// is empty, into the given rotation period with boundaries in loc. Keys carry
+// no zone, so a daily key in UTC is still the plain 2006-01-02 date.
+func resolveTimeKey(raw string, period rotationPeriod, loc *time.Location) (timeWindow, error) {
+	now := time.Now()
+	pinned := false
+	if raw != "" {
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return timeWindow{}, err
+		}
+		now = time.Unix(parsed, 0)
+		pinned = true
+	}
+	t := now.In(loc)
+	year, month, day := t.Date()
+	var start, end time.Time
+	var key string
+	switch period {
+	case rotateNever:
+		return timeWindow{key: neverKey, start: time.Unix(0, 0).UTC(), pinned: true}, nil
+	case rotateHourly:
+		start = time.Date(year, month, day, t.Hour(), 0, 0, 0, loc)
+		end = start.Add(time.Hour)
+		key = start.Format("2006-01-02T15")
+	case rotateWeekly:
+		offset := (int(t.Weekday()) + 6) % 7
+		start = time.Date(year, month, day-offset, 0, 0, 0, 0, loc)
+		end = start.AddDate(0, 0, 7)
+		isoYear, isoWeek := t.ISOWeek()
+		key = fmt.Sprintf("%04d-W%02d", isoYear, isoWeek)
+	case rotateMonthly:
+		start = time.Date(year, month, 1, 0, 0, 0, 0, loc)
+		end = start.AddDate(0, 1, 0)
+		key = start.Format("2006-01")
+	case rotateYearly:
+		start = time.Date(year, time.January, 1, 0, 0, 0, 0, loc)
+		end = start.AddDate(1, 0, 0)
+		key = start.Format("2006")
+	default:
+		start = time.Date(year, month, day, 0, 0, 0, 0, loc)
+		end = start.AddDate(0, 0, 1)
+		key = start.Format(timeKeyLayout)
+	}
+	return timeWindow{key: key, start: start, end: end, pinned: pinned}, nil
+}
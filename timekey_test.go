@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResolveTimeKey(t *testing.T) {
+	utc := time.UTC
+	tokyo, _ := time.LoadLocation("Asia/Tokyo")
+	newYork, _ := time.LoadLocation("America/New_York")
+	for _, tc := range []struct {
+		name   string
+		raw    string
+		period rotationPeriod
+		loc    *time.Location
+		key    string
+		start  string
+		end    string
+	}{
+		{"hourly", "1700000000", rotateHourly, utc, "2023-11-14T22", "2023-11-14T22:00:00Z", "2023-11-14T23:00:00Z"},
+		{"daily", "1700000000", rotateDaily, utc, "2023-11-14", "2023-11-14T00:00:00Z", "2023-11-15T00:00:00Z"},
+		{"daily ahead of UTC", "1700000000", rotateDaily, tokyo, "2023-11-15", "2023-11-14T15:00:00Z", "2023-11-15T15:00:00Z"},
+		{"daily behind UTC", "1700000000", rotateDaily, newYork, "2023-11-14", "2023-11-14T05:00:00Z", "2023-11-15T05:00:00Z"},
+		{"day the clocks go back", "1699160400", rotateDaily, newYork, "2023-11-05", "2023-11-05T04:00:00Z", "2023-11-06T05:00:00Z"},
+		{"weekly starts on Monday", "1700000000", rotateWeekly, utc, "2023-W46", "2023-11-13T00:00:00Z", "2023-11-20T00:00:00Z"},
+		{"weekly uses the ISO year", "1609459200", rotateWeekly, utc, "2020-W53", "2020-12-28T00:00:00Z", "2021-01-04T00:00:00Z"},
+		{"monthly", "1700000000", rotateMonthly, utc, "2023-11", "2023-11-01T00:00:00Z", "2023-12-01T00:00:00Z"},
+		{"yearly", "1700000000", rotateYearly, tokyo, "2023", "2022-12-31T15:00:00Z", "2023-12-31T15:00:00Z"},
+		{"never", "1700000000", rotateNever, utc, neverKey, "1970-01-01T00:00:00Z", "0001-01-01T00:00:00Z"},
+	} {
+		w, err := resolveTimeKey(tc.raw, tc.period, tc.loc)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		start, end := w.start.UTC().Format(time.RFC3339), w.end.UTC().Format(time.RFC3339)
+		if w.key != tc.key || start != tc.start || end != tc.end || !w.pinned {
+			t.Errorf("%s: got %s [%s, %s) pinned %v, want %s [%s, %s) pinned", tc.name, w.key, start, end, w.pinned, tc.key, tc.start, tc.end)
+		}
+	}
+}
+
+func TestResolveTimeKeyNow(t *testing.T) {
+	before := time.Now()
+	w, err := resolveTimeKey("", rotateHourly, time.UTC)
+	after := time.Now()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.pinned {
+		t.Error("a window resolved from the current time is pinned")
+	}
+	if after.Before(w.start) || !before.Before(w.end) || w.end.Sub(w.start) != time.Hour {
+		t.Errorf("window [%v, %v) is not the current hour", w.start, w.end)
+	}
+	if _, err := resolveTimeKey("yesterday", rotateDaily, time.UTC); err == nil {
+		t.Error("invalid timestamp accepted")
+	}
+}
+
+func TestParseRotation(t *testing.T) {
+	for _, tc := range []struct {
+		raw  string
+		want rotationPeriod
+		ok   bool
+	}{
+		{"daily", rotateDaily, true},
+		{"Weekly", rotateWeekly, true},
+		{"never", rotateNever, true},
+		{"fortnightly", "", false},
+		{"", "", false},
+	} {
+		got, err := parseRotation(tc.raw)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("parseRotation(%q) = %q, %v", tc.raw, got, err)
+		}
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// avatarTraits holds every decision behind an avatar. pickTraits and the
+// layers' Pick methods consume the hash-seeded stream and drawing only reads
+// the result, so the traits fully describe what gets drawn.
+type avatarTraits struct {
+	size       int
+	center     image.Point
+	headRadius int
+	// face is the head's shape and proportions, or nil for the round head
+	// with fixed proportions.
+	face   *faceTraits
+	colors avatarColors
+
+	hairHeight   int
+	strands      []hairStrand
+	sideburns    bool
+	cape         bool
+	shoulders    shoulderPattern
+	background   backgroundAccent
+	accessory    accessoryTraits
+	mask         bool
+	eyeShift     int
+	irisShift    int
+	browTilt     int
+	blush        bool
+	scar         bool
+	scarSlope    float64
+	mouthCurve   float64
+	lipShine     bool
+	mustache     bool
+	chinShadow   bool
+	foreheadMark bool
+	hood         bool
+	// noise is the stream the noise pass draws from; the texture is too
+	// large to be worth expanding into explicit traits.
+	noise randStream
+}
+
+type avatarColors struct {
+	background    color.RGBA
+	skin          color.RGBA
+	hair          color.RGBA
+	eye           color.RGBA
+	mouth         color.RGBA
+	accessory     color.RGBA
+	brow          color.RGBA
+	blush         color.RGBA
+	neck          color.RGBA
+	clothing      color.RGBA
+	accent        color.RGBA
+	scar          color.RGBA
+	mask          color.RGBA
+	lip           color.RGBA
+	shadow        color.RGBA
+	frame         color.RGBA
+	mark          color.RGBA
+	hood          color.RGBA
+	irisHighlight color.RGBA
+	cape          color.RGBA
+}
+
+type hairStrand struct {
+	start  image.Point
+	length int
+}
+
+type shoulderPattern string
+
+const (
+	shoulderChevron shoulderPattern = "chevron"
+	shoulderStripe  shoulderPattern = "stripe"
+)
+
+type accentKind string
+
+const (
+	accentOrbitRings    accentKind = "orbit-rings"
+	accentStars         accentKind = "stars"
+	accentHexGrid       accentKind = "hex-grid"
+	accentCircuitTrace  accentKind = "circuit-trace"
+	accentConstellation accentKind = "constellation"
+	accentAurora        accentKind = "aurora"
+)
+
+type backgroundAccent struct {
+	kind      accentKind
+	stars     []image.Point
+	hexagons  []image.Point
+	hexRadius int
+	traces    [][]image.Point
+	nodes     []image.Point
+	nodeSizes []int
+	bands     []int
+	gridStep  int
+}
+
+type accessoryKind string
+
+const (
+	accessoryGlasses  accessoryKind = "glasses"
+	accessoryHat      accessoryKind = "hat"
+	accessoryEarrings accessoryKind = "earrings"
+	accessoryFreckles accessoryKind = "freckles"
+	accessoryBeard    accessoryKind = "beard"
+)
+
+type accessoryTraits struct {
+	kind      accessoryKind
+	thickness int
+	height    int
+	freckles  []image.Point
+}
+
+// pickTraits picks every trait from stream. Shaped heads are picked before
+// the layers, whose picks depend on the head radius.
+func pickTraits(stream randStream, size int, shapedHeads bool) *avatarTraits {
+	t := &avatarTraits{size: size, center: image.Point{X: size / 2, Y: size / 2}}
+	rng := stream.substream("base")
+	t.colors.background = blendColor(pickColor(rng, backgroundPalette), 0.08)
+	t.headRadius = int(float64(size) * (0.32 + 0.06*float64(rng.nextInt(4))))
+	t.colors.skin = pickColor(rng, skinPalette)
+	t.colors.hair = pickColor(rng, hairPalette)
+	t.colors.eye = pickColor(rng, eyePalette)
+	t.colors.mouth = pickColor(rng, mouthPalette)
+	t.colors.accessory = pickColor(rng, accessoryPalette)
+	t.colors.brow = pickColor(rng, eyebrowPalette)
+	t.colors.blush = pickColor(rng, blushPalette)
+	t.colors.neck = pickColor(rng, neckPalette)
+	t.colors.clothing = pickColor(rng, clothingPalette)
+	t.colors.accent = pickColor(rng, accentPalette)
+	t.colors.scar = pickColor(rng, scarPalette)
+	t.colors.mask = pickColor(rng, maskPalette)
+	t.colors.lip = pickColor(rng, lipPalette)
+	t.colors.shadow = pickColor(rng, shadowPalette)
+	t.colors.frame = pickColor(rng, framePalette)
+	t.colors.mark = pickColor(rng, markPalette)
+	t.colors.hood = pickColor(rng, hoodPalette)
+	t.colors.irisHighlight = pickColor(rng, irisHighlightPalette)
+	t.colors.cape = pickColor(rng, capePalette)
+	if shapedHeads {
+		t.face = pickFace(stream.substream("face"), t)
+	}
+
+	for _, l := range layerRegistry {
+		l.Pick(stream.substream(l.Name()), t)
+	}
+	return t
+}
+
+func pickHairStrands(rng randStream, center image.Point, radius int) []hairStrand {
+	count := 8 + rng.nextInt(6)
+	strands := make([]hairStrand, 0, count)
+	for i := 0; i < count; i++ {
+		startX := center.X - radius + rng.nextInt(radius*2)
+		startY := center.Y - radius + rng.nextInt(radius/2)
+		length := radius/2 + rng.nextInt(radius/2)
+		strands = append(strands, hairStrand{start: image.Point{X: startX, Y: startY}, length: length})
+	}
+	return strands
+}
+
+func pickBackgroundAccent(rng randStream, center image.Point, radius int, size int) backgroundAccent {
+	switch rng.nextInt(6) {
+	case 0:
+		return backgroundAccent{kind: accentOrbitRings}
+	case 1:
+		return backgroundAccent{kind: accentStars, stars: pickStars(rng, radius)}
+	case 2:
+		hexagons, hexRadius := pickHexGrid(rng, center, radius)
+		return backgroundAccent{kind: accentHexGrid, hexagons: hexagons, hexRadius: hexRadius}
+	case 3:
+		return backgroundAccent{kind: accentCircuitTrace, traces: pickCircuitTraces(rng, center, radius, size)}
+	case 4:
+		nodes, sizes := pickConstellation(rng, center, radius)
+		return backgroundAccent{kind: accentConstellation, nodes: nodes, nodeSizes: sizes}
+	default:
+		bands := make([]int, 3+rng.nextInt(3))
+		for i := range bands {
+			bands[i] = rng.nextInt(radius) - radius/2
+		}
+		return backgroundAccent{kind: accentAurora, bands: bands, gridStep: 4 + rng.nextInt(4)}
+	}
+}
+
+func pickStars(rng randStream, radius int) []image.Point {
+	count := 12 + rng.nextInt(10)
+	stars := make([]image.Point, 0, count)
+	for i := 0; i < count; i++ {
+		x := rng.nextInt(radius*2) + radius/2
+		y := rng.nextInt(radius*2) + radius/2
+		stars = append(stars, image.Point{X: x, Y: y})
+	}
+	return stars
+}
+
+func pickHexGrid(rng randStream, center image.Point, radius int) ([]image.Point, int) {
+	step := max(radius/3, 3)
+	var hexagons []image.Point
+	for y := center.Y - radius; y <= center.Y+radius; y += step {
+		rowShift := 0
+		if ((y - center.Y) / step % 2) != 0 {
+			rowShift = step / 2
+		}
+		for x := center.X - radius; x <= center.X+radius; x += step {
+			if rng.nextInt(4) == 0 {
+				hexagons = append(hexagons, image.Point{X: x + rowShift, Y: y})
+			}
+		}
+	}
+	return hexagons, step / 3
+}
+
+func pickCircuitTraces(rng randStream, center image.Point, radius int, size int) [][]image.Point {
+	count := 4 + rng.nextInt(4)
+	unit := pixelUnit(size)
+	traces := make([][]image.Point, 0, count)
+	for i := 0; i < count; i++ {
+		current := image.Point{
+			X: center.X - radius + rng.nextInt(radius*2),
+			Y: center.Y - radius + rng.nextInt(radius*2),
+		}
+		length := radius/2 + rng.nextInt(radius/2)
+		var trace []image.Point
+		for j := 0; j < length; j += unit {
+			trace = append(trace, current)
+			switch rng.nextInt(4) {
+			case 0:
+				current.X += unit
+			case 1:
+				current.X -= unit
+			case 2:
+				current.Y += unit
+			default:
+				current.Y -= unit
+			}
+			if current.X < 0 || current.Y < 0 || current.X >= size || current.Y >= size {
+				break
+			}
+		}
+		traces = append(traces, trace)
+	}
+	return traces
+}
+
+func pickConstellation(rng randStream, center image.Point, radius int) ([]image.Point, []int) {
+	count := 6 + rng.nextInt(4)
+	nodes := make([]image.Point, 0, count)
+	for i := 0; i < count; i++ {
+		nodes = append(nodes, image.Point{
+			X: center.X - radius + rng.nextInt(radius*2),
+			Y: center.Y - radius + rng.nextInt(radius*2),
+		})
+	}
+	sizes := make([]int, count)
+	for i := range sizes {
+		sizes[i] = 1 + rng.nextInt(2)
+	}
+	return nodes, sizes
+}
+
+func pickAccessory(rng randStream, center image.Point, radius int) accessoryTraits {
+	switch rng.nextInt(5) {
+	case 0:
+		return accessoryTraits{kind: accessoryGlasses, thickness: 2 + rng.nextInt(2)}
+	case 1:
+		return accessoryTraits{kind: accessoryHat, height: radius/2 + rng.nextInt(radius/4)}
+	case 2:
+		return accessoryTraits{kind: accessoryEarrings}
+	case 3:
+		count := 6 + rng.nextInt(8)
+		freckles := make([]image.Point, 0, count)
+		for i := 0; i < count; i++ {
+			x := center.X - radius/2 + rng.nextInt(radius)
+			y := center.Y + rng.nextInt(radius/3)
+			freckles = append(freckles, image.Point{X: x, Y: y})
+		}
+		return accessoryTraits{kind: accessoryFreckles, freckles: freckles}
+	default:
+		return accessoryTraits{kind: accessoryBeard, height: radius/2 + rng.nextInt(radius/4)}
+	}
+}
+
+type traitsResponse struct {
+	Hash             string             `json:"hash"`
+	TimeKey          string             `json:"timeKey"`
+	Size             int                `json:"size"`
+	HeadRadius       int                `json:"headRadius"`
+	HeadShape        headShape          `json:"headShape,omitempty"`
+	Proportions      map[string]float64 `json:"proportions,omitempty"`
+	Colors           map[string]string  `json:"colors"`
+	Accessory        accessoryKind      `json:"accessory"`
+	BackgroundAccent accentKind         `json:"backgroundAccent"`
+	ShoulderPattern  shoulderPattern    `json:"shoulderPattern"`
+	MouthCurve       float64            `json:"mouthCurve"`
+	Features         map[string]bool    `json:"features"`
+}
+
+func newTraitsResponse(t *avatarTraits) traitsResponse {
+	c := t.colors
+	resp := traitsResponse{
+		Size:       t.size,
+		HeadRadius: t.headRadius,
+		Colors: map[string]string{
+			"background":    hexColor(c.background),
+			"skin":          hexColor(c.skin),
+			"hair":          hexColor(c.hair),
+			"eye":           hexColor(c.eye),
+			"mouth":         hexColor(c.mouth),
+			"accessory":     hexColor(c.accessory),
+			"brow":          hexColor(c.brow),
+			"blush":         hexColor(c.blush),
+			"neck":          hexColor(c.neck),
+			"clothing":      hexColor(c.clothing),
+			"accent":        hexColor(c.accent),
+			"scar":          hexColor(c.scar),
+			"mask":          hexColor(c.mask),
+			"lip":           hexColor(c.lip),
+			"shadow":        hexColor(c.shadow),
+			"frame":         hexColor(c.frame),
+			"mark":          hexColor(c.mark),
+			"hood":          hexColor(c.hood),
+			"irisHighlight": hexColor(c.irisHighlight),
+			"cape":          hexColor(c.cape),
+		},
+		Accessory:        t.accessory.kind,
+		BackgroundAccent: t.background.kind,
+		ShoulderPattern:  t.shoulders,
+		MouthCurve:       t.mouthCurve,
+		Features: map[string]bool{
+			"sideburns":    t.sideburns,
+			"cape":         t.cape,
+			"mask":         t.mask,
+			"blush":        t.blush,
+			"scar":         t.scar,
+			"lipShine":     t.lipShine,
+			"mustache":     t.mustache,
+			"chinShadow":   t.chinShadow,
+			"foreheadMark": t.foreheadMark,
+			"hood":         t.hood,
+		},
+	}
+	if f := t.face; f != nil {
+		resp.HeadShape = f.shape
+		resp.Proportions = map[string]float64{
+			"eyeSpacing": f.eyeSpacing,
+			"eyeHeight":  f.eyeHeight,
+			"mouthWidth": f.mouthWidth,
+			"chinLength": f.chinLength,
+		}
+	}
+	return resp
+}
+
+func hexColor(c color.RGBA) string {
+	if c.A == 255 {
+		return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+	}
+	return fmt.Sprintf("#%02x%02x%02x%02x", c.R, c.G, c.B, c.A)
+}
+
+// traitsHandler describes the avatar that /avatar would render for the same
+// input, size and timestamp.
+func traitsHandler(w http.ResponseWriter, r *http.Request) {
+	p := queryParams(r)
+	p.route = traitsRoute
+	req, err := parseAvatarRequest(p)
+	if err != nil {
+		http.Error(w, err.Error(), requestStatus(err))
+		return
+	}
+	hash := req.hash()
+	labelRequest(r, req.size, "traits")
+	labelInput(r, req.input, hash)
+	etag := avatarETag(hash, req.size, "traits", renderOptions{version: req.render.version})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Avatar-Hash", hex.EncodeToString(hash))
+	w.Header().Set("X-Avatar-Time-Key", req.window.key)
+	w.Header().Set("X-Avatar-Version", strconv.Itoa(req.render.version))
+	setCacheHeaders(w.Header(), etag, req.window, time.Now())
+	if notModified(r, etag, req.window.start) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	resp := newTraitsResponse(activePipelines[req.render.version].traits(hash, req.size))
+	resp.Hash = hex.EncodeToString(hash)
+	resp.TimeKey = req.window.key
+	json.NewEncoder(w).Encode(resp)
+}
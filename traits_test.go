@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestTraitsHandlerReportsVersion(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{"input=alice", strconv.Itoa(cfg.defaultVersion)},
+		{"input=alice&v=3", "3"},
+		{"input=alice&v=5", "5"},
+	} {
+		rec := httptest.NewRecorder()
+		traitsHandler(rec, httptest.NewRequest(http.MethodGet, "/avatar/traits?"+tc.query, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", tc.query, rec.Code, rec.Body)
+		}
+		if got := rec.Header().Get("X-Avatar-Version"); got != tc.want {
+			t.Errorf("%s: X-Avatar-Version = %q, want %q", tc.query, got, tc.want)
+		}
+	}
+}
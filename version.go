@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// algorithmVersion is a published rendering algorithm. Once published a
+// version must keep rendering byte-identical avatars, which its golden
+// corpus digest enforces; improvements go into a new version.
+type algorithmVersion struct {
+	number int
+	// layers adjusts the registry's layers for this version. Operator
+	// configuration is applied on top.
+	layers layerConfig
+	// streams picks traits from a ChaCha8 stream with a substream per
+	// layer instead of the legacy byte stream, which repeats after 32 values.
+	streams bool
+	// shapedHeads gives heads one of several shapes and varies the face's
+	// proportions continuously; it needs streams.
+	shapedHeads bool
+	// overwrite paints every shape over what is beneath it, alpha included,
+	// as the service did before it composited translucent colours.
+	overwrite bool
+	// golden is the SHA-256 of the version's golden corpus.
+	golden string
+	// smoke is the SHA-256 of the version's smoke render, a single render
+	// cheap enough for /readyz to repeat while serving.
+	smoke string
+}
+
+// composited draws the background gradient behind the head and shades the
+// chin with a multiply blend.
+var composited = layerConfig{
+	z:     map[string]int{"background-gradient": 5},
+	blend: map[string]blendMode{"chin-shadow": blendMultiply},
+}
+
+// clippedToHead keeps hair and beard inside the head and the hood outside
+// it, so the hood frames the face rather than covering it.
+var clippedToHead = layerConfig{
+	z:     composited.z,
+	blend: composited.blend,
+	clip: map[string]layerClip{
+		"hair":         {mask: "head"},
+		"hair-strands": {mask: "head"},
+		"beard":        {mask: "head"},
+		"hood":         {mask: "head", invert: true},
+	},
+}
+
+var publishedVersions = []algorithmVersion{
+	{
+		// Version 1 draws what the service drew before versions existed,
+		// pixel for pixel at the 64 and 128 pixel sizes it served.
+		number:    1,
+		overwrite: true,
+		golden:    "b4ed36b5b8f81ede3430cb7365decad198d96c00b05562558dc0cf0fe6fe1781",
+		smoke:     "73ceaa7a0aaa8e58df91c8ff22d05a42d0a6b77cf9023d571641906ca7d589c4",
+	},
+	{
+		// Version 2 draws the background gradient behind the head instead
+		// of over it.
+		number:    2,
+		layers:    layerConfig{z: map[string]int{"background-gradient": 5}},
+		overwrite: true,
+		golden:    "bde201626e0b6af9bb95ac59247a4aa07ee6f29df53bfa90075e1c53feab002a",
+		smoke:     "f239637c315cb1ee3d2c1ec1505dc0a6cbafba4facdeeab2a9a0cfd275a7dacd",
+	},
+	{
+		// Version 3 picks every layer from its own substream, so traits are
+		// no longer correlated and the noise texture no longer repeats. It
+		// also composites translucent colours instead of overwriting, and
+		// shades the chin with a multiply blend.
+		number:  3,
+		layers:  composited,
+		streams: true,
+		golden:  "71626ce890aabba07463c1e3f50b9565bd8b9f1525c30f06050412757dc78372",
+		smoke:   "a51cd18654d7ad57d57faa1999940b7fc630a77e6675a3c719cfe0996164cd61",
+	},
+	{
+		// Version 4 clips hair, hair strands and the beard to the head so
+		// they no longer spill past the face, and the hood to outside it so
+		// it no longer covers the face.
+		number:  4,
+		layers:  clippedToHead,
+		streams: true,
+		golden:  "1859706cb3d0ed218be15689f5a09872eaaa1396b4300e6e2e49e4d7c412a474",
+		smoke:   "c63d70de50dfd7b590b48cce72c8a09ccc87aee33657f647da087078afbfff3d",
+	},
+	{
+		// Version 5 adds head shapes and continuous face proportions.
+		number:      5,
+		layers:      clippedToHead,
+		streams:     true,
+		shapedHeads: true,
+		golden:      "e9a10c3445bd0bcd45b5c51cddb0f51aea51e0d1a185c822256a9a38ad200f4b",
+		smoke:       "6ac6186e952f53227baa9980996cc991f559b91ecad7a8fb7ee0537fbf2502da",
+	},
+}
+
+func findVersion(number int) (algorithmVersion, bool) {
+	for _, v := range publishedVersions {
+		if v.number == number {
+			return v, true
+		}
+	}
+	return algorithmVersion{}, false
+}
+
+func publishedVersionList() string {
+	numbers := make([]string, len(publishedVersions))
+	for i, v := range publishedVersions {
+		numbers[i] = strconv.Itoa(v.number)
+	}
+	return strings.Join(numbers, ", ")
+}
+
+func parseVersion(raw string) (int, error) {
+	number, err := strconv.Atoi(raw)
+	if err == nil {
+		if _, ok := findVersion(number); ok {
+			return number, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown version %q, published versions are %s", raw, publishedVersionList())
+}
+
+// pipeline builds the version's pipeline with lc applied on top of its layers.
+func (v algorithmVersion) pipeline(lc layerConfig) (*pipeline, error) {
+	p, err := newPipeline(v.layers.merge(lc))
+	if err != nil {
+		return nil, err
+	}
+	p.streams = v.streams
+	p.shapedHeads = v.shapedHeads
+	p.overwrite = v.overwrite
+	return p, nil
+}
+
+// buildPipelines builds each published version's pipeline with the operator's
+// layer configuration applied.
+func buildPipelines(lc layerConfig) (map[int]*pipeline, error) {
+	pipelines := map[int]*pipeline{}
+	for _, v := range publishedVersions {
+		p, err := v.pipeline(lc)
+		if err != nil {
+			return nil, err
+		}
+		pipelines[v.number] = p
+	}
+	return pipelines, nil
+}
+
+// activePipelines is what the service draws with; main rebuilds it from the
+// -disable-layers, -layer-z and -layer-blend flags.
+var activePipelines, _ = buildPipelines(layerConfig{})
+
+// The golden corpus is a fixed set of renders covering both encoders, both
+// rasteriser paths and a spread of sizes.
+var (
+	corpusInputs = []string{
+		"avatargenerator self-test",
+		"alice@example.com",
+		"bob@example.com",
+		"0bc83cb571cd1c50ba6f3e8a78ef1346",
+		"Ünïcödé Üser",
+		"",
+		"a",
+		"the quick brown fox jumps over the lazy dog",
+	}
+	corpusSizes = []int{16, 37, 64, 128}
+)
+
+const (
+	corpusTimeKey = "2000-01-01"
+	corpusSamples = 4
+)
+
+// corpusDigest renders the golden corpus for a version with its default
+// layers, whatever the service is configured to draw.
+func corpusDigest(v algorithmVersion) (string, error) {
+	p, err := v.pipeline(layerConfig{})
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	for _, input := range corpusInputs {
+		hash := hashInput(input, corpusTimeKey)
+		for _, size := range corpusSizes {
+			crisp := image.NewRGBA(image.Rect(0, 0, size, size))
+			p.render(newRasterCanvas(crisp), hash)
+			h.Write(crisp.Pix)
+
+			smooth := image.NewRGBA(image.Rect(0, 0, size, size))
+			p.render(newSmoothRasterCanvas(smooth, corpusSamples), hash)
+			h.Write(smooth.Pix)
+
+			for _, antialias := range []bool{false, true} {
+				svg := newSVGCanvas(size)
+				svg.crisp = !antialias
+				p.render(svg, hash)
+				h.Write(svg.Bytes())
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+const smokeSize = 64
+
+// smokeDigest renders the first corpus input once, crisp, at smokeSize.
+func smokeDigest(v algorithmVersion) (string, error) {
+	p, err := v.pipeline(layerConfig{})
+	if err != nil {
+		return "", err
+	}
+	img := image.NewRGBA(image.Rect(0, 0, smokeSize, smokeSize))
+	p.render(newRasterCanvas(img), hashInput(corpusInputs[0], corpusTimeKey))
+	sum := sha256.Sum256(img.Pix)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// verifySmoke checks every published version against its smoke digest.
+func verifySmoke() error {
+	var errs []error
+	for _, v := range publishedVersions {
+		got, err := smokeDigest(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("version %d: %w", v.number, err))
+		} else if got != v.smoke {
+			errs = append(errs, fmt.Errorf("version %d renders smoke digest %s, golden is %s", v.number, got, v.smoke))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// runVerify implements the "verify" subcommand, which prints each version's
+// corpus and smoke digests and fails if any differs from its golden value.
+func runVerify(stdout io.Writer) error {
+	failed := 0
+	for _, v := range publishedVersions {
+		for _, check := range []struct {
+			name   string
+			digest func(algorithmVersion) (string, error)
+			golden string
+		}{
+			{"corpus", corpusDigest, v.golden},
+			{"smoke", smokeDigest, v.smoke},
+		} {
+			got, err := check.digest(v)
+			if err != nil {
+				return err
+			}
+			status := "ok"
+			if got != check.golden {
+				status = "MISMATCH"
+				failed++
+			}
+			fmt.Fprintf(stdout, "v%d %s %s %s\n", v.number, check.name, got, status)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d published digests no longer match their golden value", failed)
+	}
+	return nil
+}
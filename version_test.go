@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"strconv"
+	"testing"
+)
+
+func TestPublishedVersionsRenderGoldenCorpus(t *testing.T) {
+	if testing.Short() {
+		t.Skip("renders the full golden corpus")
+	}
+	for _, v := range publishedVersions {
+		t.Run("v"+strconv.Itoa(v.number), func(t *testing.T) {
+			t.Parallel()
+			got, err := corpusDigest(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != v.golden {
+				t.Errorf("corpus digest %s, golden is %s", got, v.golden)
+			}
+		})
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	for _, tc := range []struct {
+		raw  string
+		want int
+		ok   bool
+	}{
+		{"1", 1, true},
+		{"5", 5, true},
+		{"0", 0, false},
+		{"99", 0, false},
+		{"v2", 0, false},
+		{"", 0, false},
+	} {
+		got, err := parseVersion(tc.raw)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("parseVersion(%q) = %d, %v; want %d, ok %v", tc.raw, got, err, tc.want, tc.ok)
+		}
+	}
+}
+
+// TestClippedToHead checks where each layer may change the avatar: the hood
+// only outside the head, the beard only inside it, and the hat on both sides
+// because its crown must not be clipped away.
+func TestClippedToHead(t *testing.T) {
+	const size = 128
+	for _, v := range publishedVersions {
+		if _, clipped := v.layers.clip["hood"]; !clipped {
+			continue
+		}
+		p, err := v.pipeline(layerConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tc := range []struct {
+			layer string
+			drawn func(*avatarTraits) bool
+			want  string
+		}{
+			{"hood", func(tr *avatarTraits) bool { return tr.hood }, "outside"},
+			{"accessories", func(tr *avatarTraits) bool { return tr.accessory.kind == accessoryHat }, "inside and outside"},
+			{"beard", func(tr *avatarTraits) bool { return tr.accessory.kind == accessoryBeard }, "inside"},
+		} {
+			found := 0
+			for i := 0; found < 3 && i < 200; i++ {
+				hash := hashInput("clip "+strconv.Itoa(i), corpusTimeKey)
+				if !tc.drawn(p.traits(hash, size)) {
+					continue
+				}
+				found++
+				with := newRasterCanvas(image.NewRGBA(image.Rect(0, 0, size, size)))
+				p.render(with, hash)
+				without := newRasterCanvas(image.NewRGBA(image.Rect(0, 0, size, size)))
+				p.without([]string{tc.layer}).render(without, hash)
+
+				head := with.masks["head"]
+				changedInside, changedOutside := false, false
+				for px, coverage := range head {
+					if bytes.Equal(with.img.Pix[4*px:4*px+4], without.img.Pix[4*px:4*px+4]) {
+						continue
+					}
+					switch coverage {
+					case 255:
+						changedInside = true
+					case 0:
+						changedOutside = true
+					}
+				}
+				got := map[[2]bool]string{
+					{false, false}: "nowhere",
+					{true, false}:  "inside",
+					{false, true}:  "outside",
+					{true, true}:   "inside and outside",
+				}[[2]bool{changedInside, changedOutside}]
+				if got != tc.want {
+					t.Errorf("v%d input %d: %s changes pixels %s the head, want %s", v.number, i, tc.layer, got, tc.want)
+				}
+			}
+			if found == 0 {
+				t.Errorf("v%d: no input draws the %s", v.number, tc.layer)
+			}
+		}
+	}
+}